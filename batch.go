@@ -0,0 +1,98 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultBatchSize is the default number of writes a WriteBatch
+// keeps in flight. It is well within the 255 tags available on a
+// single venti connection.
+const DefaultBatchSize = 128
+
+// A WriteBatch pipelines block writes to an underlying BlockWriter.
+// WriteBlock computes the score locally and returns immediately,
+// while the actual write proceeds in the background. At most a fixed
+// number of writes are in flight at once, each holding a private copy
+// of its block, which bounds the memory used by the batch.
+//
+// Errors from background writes are collected and returned by Flush.
+// A WriteBatch is safe for concurrent use.
+type WriteBatch struct {
+	bw  BlockWriter
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// NewWriteBatch returns a WriteBatch that writes to bw, keeping
+// at most n writes in flight. If n <= 0, DefaultBatchSize is used.
+func NewWriteBatch(bw BlockWriter, n int) *WriteBatch {
+	if n <= 0 {
+		n = DefaultBatchSize
+	}
+	return &WriteBatch{
+		bw:  bw,
+		sem: make(chan struct{}, n),
+	}
+}
+
+// WriteBlock starts writing buf as a block of the given type and
+// returns its score without waiting for the write to complete.
+// It blocks only while the maximum number of writes is in flight.
+// The returned error is non-nil only if ctx is done before the write
+// could be started; errors from the write itself are reported by Flush.
+//
+// The write uses ctx, so it must not be cancelled before Flush returns.
+// The caller may reuse buf as soon as WriteBlock returns.
+func (b *WriteBatch) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
+	score := Fingerprint(buf)
+	if len(buf) == 0 {
+		return score, nil
+	}
+
+	select {
+	case b.sem <- struct{}{}:
+	case <-ctx.Done():
+		return Score{}, ctx.Err()
+	}
+
+	block := make([]byte, len(buf))
+	copy(block, buf)
+
+	b.wg.Add(1)
+	go func() {
+		defer func() {
+			<-b.sem
+			b.wg.Done()
+		}()
+		s, err := b.bw.WriteBlock(ctx, t, block)
+		if err == nil && s != score {
+			err = fmt.Errorf("score mismatch: got %v, want %v", s, score)
+		}
+		if err != nil {
+			b.mu.Lock()
+			b.errs = append(b.errs, fmt.Errorf("write %v: %w", score, err))
+			b.mu.Unlock()
+		}
+	}()
+
+	return score, nil
+}
+
+// Flush waits for all writes started so far to complete, and returns
+// the errors encountered by any of them. After Flush returns, the batch
+// may be reused.
+func (b *WriteBatch) Flush() error {
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := errors.Join(b.errs...)
+	b.errs = nil
+	return err
+}
@@ -0,0 +1,112 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// latency delays each call by a fixed time, and records the
+// greatest number of calls in progress at once, to test the
+// pipelining of slow stores.
+type latency struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (l *latency) wait() {
+	l.mu.Lock()
+	l.inflight++
+	if l.inflight > l.max {
+		l.max = l.inflight
+	}
+	l.mu.Unlock()
+
+	time.Sleep(l.delay)
+
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+}
+
+type slowWriter struct {
+	latency
+	fail map[Score]bool
+
+	wmu     sync.Mutex
+	written map[Score][]byte
+}
+
+func (w *slowWriter) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
+	w.wait()
+
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	s := Fingerprint(buf)
+	if w.fail[s] {
+		return Score{}, errors.New("injected failure")
+	}
+	if w.written == nil {
+		w.written = make(map[Score][]byte)
+	}
+	w.written[s] = buf
+	return s, nil
+}
+
+func TestWriteBatch(t *testing.T) {
+	ctx := context.Background()
+
+	bad := Fingerprint([]byte("block 7"))
+	sw := &slowWriter{
+		latency: latency{delay: 10 * time.Millisecond},
+		fail:    map[Score]bool{bad: true},
+	}
+	b := NewWriteBatch(sw, 8)
+
+	buf := make([]byte, 0, 16)
+	for i := 0; i < 32; i++ {
+		buf = fmt.Appendf(buf[:0], "block %d", i)
+		s, err := b.WriteBlock(ctx, DataType, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != Fingerprint(buf) {
+			t.Errorf("block %d: bad score %v", i, s)
+		}
+	}
+
+	err := b.Flush()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	t.Logf("flush: %v", err)
+
+	if sw.max > 8 {
+		t.Errorf("too many writes in flight: %d > 8", sw.max)
+	}
+	if sw.max < 2 {
+		t.Errorf("writes were not pipelined: max in flight %d", sw.max)
+	}
+	if len(sw.written) != 31 {
+		t.Errorf("wrote %d blocks, want 31", len(sw.written))
+	}
+	for s, data := range sw.written {
+		if Fingerprint(data) != s {
+			t.Errorf("block %v was modified after WriteBlock returned", s)
+		}
+	}
+
+	// the batch is reusable, and previous errors are cleared
+	if _, err := b.WriteBlock(ctx, DataType, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Errorf("flush: %v", err)
+	}
+}
@@ -32,7 +32,7 @@ func intToBig(n int) (uint16, error) {
 }
 
 func bigToInt(n uint16) int {
-	return int((n >> 5) << (n & 31))
+	return int(n>>5) << (n & 31)
 }
 
 func readUint48(r io.Reader) (uint64, error) {
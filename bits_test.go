@@ -0,0 +1,15 @@
+package venti
+
+import "testing"
+
+func TestBigToInt(t *testing.T) {
+	for _, n := range []int{256, 8192, 1 << 16, 112 * 1024, 1 << 20, 16 << 20} {
+		b, err := intToBig(n)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if got := bigToInt(b); got != n {
+			t.Errorf("bigToInt(intToBig(%d)) = %d", n, got)
+		}
+	}
+}
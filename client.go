@@ -3,8 +3,10 @@ package venti
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
 	"math"
 	"net"
 	"strings"
@@ -26,10 +28,29 @@ const (
 
 const VentiPort = 17034
 
+// idleTimeout is the default time a connection may go without any
+// traffic from the server while requests are outstanding before it
+// is considered dead.
+const idleTimeout = 1 * time.Minute
+
+// supportedVersions lists the protocol versions implemented by the
+// client, in order of preference. Version 04 differs from 02 only
+// in allowing messages, and therefore blocks, larger than 64k.
 var supportedVersions = []string{
+	"04",
 	"02",
 }
 
+const (
+	// MaxBlockSize is the largest block that can be
+	// transferred using venti protocol version 02.
+	MaxBlockSize = 56 * 1024
+
+	// MaxBigBlockSize is the largest block that can be
+	// transferred using venti protocol version 04.
+	MaxBigBlockSize = 16 * 1024 * 1024
+)
+
 type Client struct {
 	// the underlying network connection
 	rwc net.Conn
@@ -41,6 +62,8 @@ type Client struct {
 	uid     string
 	sid     string
 
+	logger *log.Logger
+
 	rpc *rpc.Client
 }
 
@@ -59,43 +82,119 @@ type BlockWriter interface {
 	WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error)
 }
 
-func Dial(ctx context.Context, address string) (*Client, error) {
-	var d net.Dialer
-	rwc, err := d.DialContext(ctx, "tcp", address)
-	if err != nil {
-		return nil, err
+// A BlockStore reads and writes blocks. Client, MemStore and
+// ShardedStore are BlockStores.
+type BlockStore interface {
+	BlockReader
+	BlockWriter
+
+	// Sync waits until all previous writes are durable.
+	Sync(ctx context.Context) error
+}
+
+// Dial connects to the venti server at address, negotiates
+// a protocol version and says hello. The context bounds only
+// the connection setup; each request is bounded by its own context.
+func Dial(ctx context.Context, address string, opts ...DialOption) (*Client, error) {
+	cfg := defaultDialConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if len(cfg.versions) == 0 {
+		return nil, errors.New("no supported protocol versions")
 	}
 
-	c := &Client{
-		rwc:  rwc,
-		bufr: bufio.NewReader(rwc),
-		uid:  "foobar",
+	if cfg.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.handshakeTimeout)
+		defer cancel()
 	}
 
-	if deadline, ok := ctx.Deadline(); ok {
-		if err := c.rwc.SetDeadline(deadline); err != nil {
+	rwc := cfg.conn
+	if rwc == nil {
+		var err error
+		rwc, err = cfg.dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
 			return nil, err
 		}
-	} else {
-		c.rwc.SetDeadline(time.Time{})
 	}
 
-	if err := c.negotiateVersion(); err != nil {
-		return nil, fmt.Errorf("handshake: %v", err)
+	c := &Client{
+		rwc:    rwc,
+		bufr:   bufio.NewReader(rwc),
+		uid:    cfg.uid,
+		logger: cfg.logger,
 	}
+	c.logf("connected to %v", rwc.RemoteAddr())
 
-	c.rpc = rpc.NewClient(rwc)
+	if err := c.handshake(ctx, cfg.versions); err != nil {
+		rwc.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+	c.logf("negotiated version %s", c.version)
+
+	rcfg := rpc.Config{
+		IdleTimeout:  cfg.idleTimeout,
+		Logf:         c.logf,
+		LongMessages: c.bigBlocks(),
+	}
+	if cfg.observer != nil {
+		rcfg.Observer = rpcObserver{cfg.observer}
+	}
+	c.rpc = rpc.NewClient(rwc, rcfg)
 
 	if err := c.hello(ctx); err != nil {
 		c.Close()
 		return nil, err
 	}
+	c.logf("hello: uid=%q sid=%q", c.uid, c.sid)
 
 	return c, nil
 }
 
-func (c *Client) negotiateVersion() error {
-	vs := fmt.Sprintf("venti-%s-sigint.ca/venti\n", strings.Join(supportedVersions, ":"))
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, args...)
+	}
+}
+
+// handshake negotiates the protocol version, bounded by ctx.
+// The connection deadline is only used for the duration of the
+// handshake; afterwards each request is bounded by its own context.
+func (c *Client) handshake(ctx context.Context, versions []string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.rwc.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		// unblock any pending I/O
+		c.rwc.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := c.negotiateVersion(versions)
+
+	if !stop() {
+		// ctx was cancelled; the deadline set by
+		// the AfterFunc is still in effect.
+		return ctx.Err()
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			// the connection deadline is ctx's, which may
+			// expire just before ctx itself
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	return c.rwc.SetDeadline(time.Time{})
+}
+
+func (c *Client) negotiateVersion(versions []string) error {
+	vs := fmt.Sprintf("venti-%s-sigint.ca/venti\n", strings.Join(versions, ":"))
 	if _, err := c.rwc.Write([]byte(vs)); err != nil {
 		return err
 	}
@@ -118,8 +217,9 @@ func (c *Client) negotiateVersion() error {
 		return fmt.Errorf("bad version string: %q", vs)
 	}
 
-	for _, v := range serverSupported {
-		for _, vv := range supportedVersions {
+	// prefer the client's ordering
+	for _, v := range versions {
+		for _, vv := range serverSupported {
 			if v == vv {
 				c.version = v
 				return nil
@@ -134,8 +234,23 @@ type helloRequest struct {
 	Version  string
 	Uid      string
 	Strength uint8
-	Crypto   string "short"
-	Codec    string "short"
+	Crypto   string
+	Codec    string
+}
+
+func (m *helloRequest) MarshalRPC(buf []byte) ([]byte, error) {
+	var err error
+	if buf, err = rpc.AppendString(buf, m.Version); err != nil {
+		return nil, err
+	}
+	if buf, err = rpc.AppendString(buf, m.Uid); err != nil {
+		return nil, err
+	}
+	buf = append(buf, m.Strength)
+	if buf, err = rpc.AppendShortString(buf, m.Crypto); err != nil {
+		return nil, err
+	}
+	return rpc.AppendShortString(buf, m.Codec)
 }
 
 type helloResponse struct {
@@ -144,14 +259,21 @@ type helloResponse struct {
 	Rcodec  uint8
 }
 
+func (m *helloResponse) UnmarshalRPC(d *rpc.Decoder) error {
+	m.Sid = d.String()
+	m.Rcrypto = d.Uint8()
+	m.Rcodec = d.Uint8()
+	return d.Err()
+}
+
 func (c *Client) hello(ctx context.Context) error {
 	req := helloRequest{
 		Version: c.version,
 		Uid:     c.uid,
 	}
 	var res helloResponse
-	if err := c.rpc.Call(ctx, rpcHello, req, &res); err != nil {
-		return fmt.Errorf("hello: %v", err)
+	if err := c.rpc.Call(ctx, rpcHello, &req, &res); err != nil {
+		return fmt.Errorf("hello: %w", serverError(err))
 	}
 	c.sid = res.Sid
 
@@ -159,62 +281,98 @@ func (c *Client) hello(ctx context.Context) error {
 }
 
 func (c *Client) goodbye() {
-	var req, res struct{}
-
-	// Venti servers do not respond to goodbye calls, but terminate
-	// the connection immediately. Cancelling the request but not
-	// setting a deadline is a hack that allows rpc.Call to return
-	// immediately after sending the message.
-	// This is extremely fragile.
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-
-	c.rpc.Call(ctx, rpcGoodbye, req, &res)
+	// Venti servers do not respond to goodbye calls, but
+	// terminate the connection immediately.
+	c.rpc.Send(rpcGoodbye, rpc.Empty{})
 }
 
 func (c *Client) Ping(ctx context.Context) error {
-	var req, res struct{}
-	if err := c.rpc.Call(ctx, rpcPing, req, &res); err != nil {
+	if err := c.rpc.Call(ctx, rpcPing, rpc.Empty{}, rpc.Empty{}); err != nil {
 		if _, ok := err.(rpc.ServerError); ok {
 			// The plan9 venti server responds to pings with
 			// an error. Treat this as a ping response.
 			return nil
 		}
-		return fmt.Errorf("ping: %v", err)
+		return fmt.Errorf("ping: %w", err)
 	}
 
 	return nil
 }
 
+// Version returns the negotiated protocol version.
+func (c *Client) Version() string {
+	return c.version
+}
+
+// MaxBlockSize returns the largest block that can be read or
+// written using the negotiated protocol version.
+func (c *Client) MaxBlockSize() int {
+	if c.bigBlocks() {
+		return MaxBigBlockSize
+	}
+	return MaxBlockSize
+}
+
+func (c *Client) bigBlocks() bool {
+	return c.version == "04"
+}
+
 type readRequest struct {
 	Score Score
 	Type  uint8
 	Pad   uint8
-	Count uint16
+	Count uint32
 }
 
+func (m *readRequest) MarshalRPC(buf []byte) ([]byte, error) {
+	buf = append(buf, m.Score[:]...)
+	buf = append(buf, m.Type, m.Pad)
+	if m.Count > math.MaxUint16 {
+		// only valid in protocol version 04
+		return binary.BigEndian.AppendUint32(buf, m.Count), nil
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(m.Count)), nil
+}
+
+// readResponse reads the block directly into Data, which is
+// resliced to the length of the block.
 type readResponse struct {
 	Data []byte
 }
 
+func (m *readResponse) UnmarshalRPC(d *rpc.Decoder) error {
+	n := d.Len()
+	if n > len(m.Data) {
+		return fmt.Errorf("block too large: %d > %d", n, len(m.Data))
+	}
+	m.Data = m.Data[:n]
+	d.Bytes(m.Data)
+	return d.Err()
+}
+
 func (c *Client) ReadBlock(ctx context.Context, s Score, t BlockType, buf []byte) (int, error) {
 	if s == ZeroScore() {
 		return 0, nil
 	}
-	if len(buf) > math.MaxUint16 {
-		return 0, errors.New("oversized buffer")
+	if t.onDiskType() == CorruptType {
+		return 0, fmt.Errorf("read: %w: %d", ErrBadType, t)
+	}
+	count := len(buf)
+	if max := c.MaxBlockSize(); count > max {
+		// no block can be larger than this
+		count = max
 	}
 
 	req := readRequest{
 		Score: s,
 		Type:  t.onDiskType(),
-		Count: uint16(len(buf)),
+		Count: uint32(count),
 	}
 	res := readResponse{
-		Data: buf,
+		Data: buf[:count],
 	}
-	if err := c.rpc.Call(ctx, rpcRead, req, &res); err != nil {
-		return 0, fmt.Errorf("read: %v", err)
+	if err := c.rpc.Call(ctx, rpcRead, &req, &res); err != nil {
+		return 0, fmt.Errorf("read: %w", serverError(err))
 	}
 
 	return len(res.Data), nil
@@ -226,16 +384,30 @@ type writeRequest struct {
 	Data []byte
 }
 
+func (m *writeRequest) MarshalRPC(buf []byte) ([]byte, error) {
+	buf = append(buf, m.Type)
+	buf = append(buf, m.Pad[:]...)
+	return append(buf, m.Data...), nil
+}
+
 type writeResponse struct {
 	Score Score
 }
 
+func (m *writeResponse) UnmarshalRPC(d *rpc.Decoder) error {
+	d.Bytes(m.Score[:])
+	return d.Err()
+}
+
 func (c *Client) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
 	if len(buf) == 0 {
 		return ZeroScore(), nil
 	}
-	if len(buf) > math.MaxUint16 {
-		return Score{}, errors.New("oversized buffer")
+	if t.onDiskType() == CorruptType {
+		return Score{}, fmt.Errorf("write: %w: %d", ErrBadType, t)
+	}
+	if max := c.MaxBlockSize(); len(buf) > max {
+		return Score{}, fmt.Errorf("oversized block: %d > %d", len(buf), max)
 	}
 
 	req := writeRequest{
@@ -243,22 +415,21 @@ func (c *Client) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score
 		Type: t.onDiskType(),
 	}
 	var res writeResponse
-	if err := c.rpc.Call(ctx, rpcWrite, req, &res); err != nil {
-		return Score{}, fmt.Errorf("write: %v", err)
+	if err := c.rpc.Call(ctx, rpcWrite, &req, &res); err != nil {
+		return Score{}, fmt.Errorf("write: %w", serverError(err))
 	}
 
 	return res.Score, nil
 }
 
 func (c *Client) Sync(ctx context.Context) error {
-	var req, res struct{}
-	if err := c.rpc.Call(ctx, rpcSync, req, &res); err != nil {
-		return fmt.Errorf("sync: %v", err)
+	if err := c.rpc.Call(ctx, rpcSync, rpc.Empty{}, rpc.Empty{}); err != nil {
+		return fmt.Errorf("sync: %w", serverError(err))
 	}
 	return nil
 }
 
 func (c *Client) Close() error {
 	c.goodbye()
-	return c.rwc.Close()
+	return c.rpc.Close()
 }
@@ -1,9 +1,15 @@
 package venti
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"testing"
 	"time"
 
@@ -21,8 +27,7 @@ func TestBadRequestType(t *testing.T) {
 		t.Fatalf("dial venti: %v", err)
 	}
 
-	var req, res struct{}
-	if err := client.rpc.Call(ctx, 0, req, &res); err == nil {
+	if err := client.rpc.Call(ctx, 0, rpc.Empty{}, rpc.Empty{}); err == nil {
 		t.Error("expected error")
 	} else if _, ok := err.(rpc.ServerError); !ok {
 		if ctx.Err() == nil {
@@ -34,9 +39,11 @@ func TestBadRequestType(t *testing.T) {
 		}
 	}
 
-	// connection already closed; should error
-	if err := client.Close(); err == nil {
-		t.Error("expected error")
+	// The call's deadline does not affect the connection, which
+	// may or may not have been closed by the server; either way,
+	// closing the client succeeds.
+	if err := client.Close(); err != nil {
+		t.Error(err)
 	}
 }
 
@@ -57,12 +64,21 @@ func TestReadUnknownScore(t *testing.T) {
 	res := readResponse{
 		Data: make([]byte, 6),
 	}
-	if err := client.rpc.Call(ctx, rpcRead, req, &res); err == nil {
+	if err := client.rpc.Call(ctx, rpcRead, &req, &res); err == nil {
 		t.Error("expected error")
 	} else if _, ok := err.(rpc.ServerError); !ok {
 		t.Errorf("%v (unexpected)", err)
 	}
 
+	_, err = client.ReadBlock(ctx, req.Score, DataType, res.Data)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Errorf("%v is not a ServerError", err)
+	}
+
 	if err := client.Close(); err != nil {
 		t.Errorf("%v (unexpected)", err)
 	}
@@ -179,3 +195,132 @@ func BenchmarkPing(b *testing.B) {
 		b.Error(err)
 	}
 }
+
+func BenchmarkReadBlock(b *testing.B) {
+	ctx := context.Background()
+
+	client, err := Dial(ctx, testAddr)
+	if err != nil {
+		b.Fatalf("dial venti: %v", err)
+	}
+
+	block := make([]byte, DefaultDataSize)
+	copy(block, "benchmark block")
+	s, err := client.WriteBlock(ctx, DataType, block)
+	if err != nil {
+		b.Fatalf("write block: %v", err)
+	}
+
+	b.SetBytes(int64(len(block)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, len(block))
+		for pb.Next() {
+			if _, err := client.ReadBlock(ctx, s, DataType, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	if err := client.Close(); err != nil {
+		b.Error(err)
+	}
+}
+
+func BenchmarkWriteBlock(b *testing.B) {
+	ctx := context.Background()
+
+	client, err := Dial(ctx, testAddr)
+	if err != nil {
+		b.Fatalf("dial venti: %v", err)
+	}
+
+	block := make([]byte, DefaultDataSize)
+	copy(block, "benchmark block")
+
+	b.SetBytes(int64(len(block)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := client.WriteBlock(ctx, DataType, block); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	if err := client.Close(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestDialOptions(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+
+	hello := make(chan string, 2)
+	go func() {
+		defer srvConn.Close()
+		bufr := bufio.NewReader(srvConn)
+		vs, err := bufr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		hello <- vs
+		io.WriteString(srvConn, "venti-02:04-fake\n")
+
+		// hello request: length, id, tag, version, uid
+		var hdr [4]byte
+		io.ReadFull(bufr, hdr[:])
+		d := make([]byte, binary.BigEndian.Uint16(hdr[:])-2)
+		io.ReadFull(bufr, d)
+		n := binary.BigEndian.Uint16(d)
+		d = d[2+n:]
+		n = binary.BigEndian.Uint16(d)
+		hello <- string(d[2 : 2+n])
+
+		// hello response: empty sid, rcrypto, rcodec
+		srvConn.Write([]byte{0, 6, rpcHello + 1, hdr[3], 0, 0, 0, 0})
+		io.Copy(io.Discard, bufr)
+	}()
+
+	var logbuf bytes.Buffer
+	ctx := context.Background()
+	client, err := Dial(ctx, "ignored",
+		WithConn(cliConn),
+		WithUid("glenda"),
+		WithVersions("02", "99"),
+		WithHandshakeTimeout(time.Second),
+		WithLogger(log.New(&logbuf, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if vs := <-hello; vs != "venti-02-sigint.ca/venti\n" {
+		t.Errorf("bad version string: %q", vs)
+	}
+	if uid := <-hello; uid != "glenda" {
+		t.Errorf("bad uid: got %q, want %q", uid, "glenda")
+	}
+	if client.version != "02" {
+		t.Errorf("bad version: got %q, want %q", client.version, "02")
+	}
+	if logbuf.Len() == 0 {
+		t.Error("nothing logged")
+	}
+	t.Logf("log:\n%s", logbuf.String())
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	go io.Copy(io.Discard, srvConn) // never respond
+
+	_, err := Dial(context.Background(), "ignored",
+		WithConn(cliConn),
+		WithHandshakeTimeout(10*time.Millisecond),
+	)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
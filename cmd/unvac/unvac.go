@@ -13,6 +13,8 @@ import (
 	"sigint.ca/venti2/vac"
 )
 
+var readAhead = flag.Int("r", 16, "Fetch up to `n` blocks of each file in parallel.")
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("unvac: ")
@@ -55,11 +57,12 @@ func main() {
 
 func unvacDir(ctx context.Context, br venti.BlockReader, dir string, f *vac.File) error {
 	scanner := vac.NewDirScanner(ctx, br, f)
+	defer scanner.Close()
 	for scanner.Scan() {
 		e := scanner.DirEntry()
 		ff, err := f.Walk(ctx, br, e)
 		if err != nil {
-			return fmt.Errorf("walk: %v", err)
+			return fmt.Errorf("walk: %w", err)
 		}
 		if e.Mode&vac.ModeDir != 0 {
 			dir := filepath.Join(dir, e.Elem)
@@ -74,7 +77,7 @@ func unvacDir(ctx context.Context, br venti.BlockReader, dir string, f *vac.File
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("scan: %v", err)
+		return fmt.Errorf("scan: %w", err)
 	}
 
 	return nil
@@ -88,7 +91,9 @@ func writeFile(ctx context.Context, br venti.BlockReader, dir string, f *vac.Fil
 	// TODO: set file metadata
 
 	defer dest.Close()
-	if _, err := f.Reader(ctx, br).WriteTo(dest); err != nil {
+	r := f.Reader(ctx, br, venti.WithReadAhead(*readAhead))
+	defer r.Close()
+	if _, err := r.WriteTo(dest); err != nil {
 		return err
 	}
 	return nil
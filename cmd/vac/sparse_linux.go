@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"syscall"
+)
+
+// lseek whence values for finding the data and holes in a file
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// A sparseReader reads a file, using SEEK_DATA and SEEK_HOLE
+// to skip its holes rather than read them.
+type sparseReader struct {
+	f    *os.File
+	size int64
+	off  int64 // the offset of the next read
+	end  int64 // the end of the data region containing off
+}
+
+func newSparseReader(f *os.File, fi os.FileInfo) io.Reader {
+	return &sparseReader{f: f, size: fi.Size()}
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if r.off < r.end && int64(len(p)) > r.end-r.off {
+		p = p[:r.end-r.off]
+	}
+	n, err := r.f.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+// ReadHole implements venti.HoleReader.
+func (r *sparseReader) ReadHole() (int64, error) {
+	if r.off < r.end || r.off >= r.size {
+		return 0, nil
+	}
+
+	data, err := r.f.Seek(r.off, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		// a hole runs to the end of the file
+		data = r.size
+	} else if errors.Is(err, syscall.EINVAL) {
+		// not supported: read everything
+		r.end = math.MaxInt64
+		_, err := r.f.Seek(r.off, io.SeekStart)
+		return 0, err
+	} else if err != nil {
+		return 0, err
+	}
+
+	r.end = r.size
+	if data < r.size {
+		if r.end, err = r.f.Seek(data, seekHole); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := r.f.Seek(data, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n := data - r.off
+	r.off = data
+	return n, nil
+}
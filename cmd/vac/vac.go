@@ -16,10 +16,15 @@ import (
 
 var (
 	blocksize = flag.String("b", "8k", "Specifies  the `blocksize` that data will be broken into."+
-		"The size must be in the range of 512 bytes to 52k.")
+		"The size must be in the range of 512 bytes to 52k, or up to 16m "+
+		"if the server supports venti protocol version 04.")
 	verboseMode = flag.Bool("v", false, "Print file names as they are added to the archive.")
+	statsMode   = flag.Bool("stats", false, "Print venti request statistics to standard error when done.")
+	sparseMode  = flag.Bool("s", false, "Store runs of zeros compactly, and skip the holes in sparse files where supported.")
+	writeAhead  = flag.Int("w", 16, "Write up to `n` blocks of each file in parallel.")
 
 	bsize, psize int
+	writerOpts   []venti.WriterOption
 )
 
 func main() {
@@ -42,29 +47,51 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if n < 512 || n > 52*1024 {
-		log.Fatalf("blocksize must be between 512 and 52k")
+	if n < 512 || n > venti.MaxBigBlockSize {
+		log.Fatalf("blocksize must be between 512 and 16m")
 	}
 	bsize = int(n)
-	psize = bsize - (bsize % venti.ScoreSize)
+	psize = venti.PointerSize(bsize)
+	writerOpts = append(writerOpts, venti.WithWriteConcurrency(*writeAhead))
+	if *sparseMode {
+		writerOpts = append(writerOpts, venti.WithSparse())
+	}
+
+	// large block sizes must be representable in an entry
+	e := venti.Entry{Psize: psize, Dsize: bsize}
+	if err := e.Pack(make([]byte, venti.EntrySize)); err != nil {
+		log.Fatalf("unsupported blocksize %d: %v", bsize, err)
+	}
 	paths := flag.Args()
 
 	ctx := context.Background()
 	ctx, cancel := withSignals(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	client, err := venti.Dial(ctx, ":17034")
+	var opts []venti.DialOption
+	var counters venti.Counters
+	if *statsMode {
+		opts = append(opts, venti.WithObserver(&counters))
+		defer counters.WriteTo(os.Stderr)
+	}
+
+	client, err := venti.Dial(ctx, ":17034", opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer client.Close()
 
+	if bsize > client.MaxBlockSize() {
+		log.Fatalf("blocksize %d is too large for venti protocol version %s (max %d)",
+			bsize, client.Version(), client.MaxBlockSize())
+	}
+
 	score, err := vacPaths(ctx, client, paths)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("vac:%v\n", &score)
+	fmt.Printf("vac:%v\n", score)
 }
 
 func vacPaths(ctx context.Context, bw venti.BlockWriter, paths []string) (venti.Score, error) {
@@ -85,8 +112,7 @@ func vacPaths(ctx context.Context, bw venti.BlockWriter, paths []string) (venti.
 		if fi.IsDir() {
 			vf, err = vacDir(ctx, bw, path, f, fi)
 		} else {
-			meta := vac.FileInfoDirEntry(fi)
-			vf, err = vac.NewFile(ctx, bw, f, meta, bsize)
+			vf, err = vacFile(ctx, bw, f, fi)
 		}
 		if err != nil {
 			return venti.Score{}, err
@@ -105,6 +131,15 @@ func vacPaths(ctx context.Context, bw venti.BlockWriter, paths []string) (venti.
 	return vac.WriteRoot(ctx, bw, vf)
 }
 
+func vacFile(ctx context.Context, bw venti.BlockWriter, f *os.File, fi os.FileInfo) (*vac.File, error) {
+	var r io.Reader = f
+	if *sparseMode {
+		r = newSparseReader(f, fi)
+	}
+	meta := vac.FileInfoDirEntry(fi)
+	return vac.NewFile(ctx, bw, r, meta, bsize, writerOpts...)
+}
+
 func vacDir(ctx context.Context, bw venti.BlockWriter, path string, dir *os.File, fi os.FileInfo) (*vac.File, error) {
 	w := vac.NewDirWriter(ctx, bw, bsize)
 	for {
@@ -132,8 +167,7 @@ func vacDir(ctx context.Context, bw venti.BlockWriter, path string, dir *os.File
 		if fi.IsDir() {
 			vf, err = vacDir(ctx, bw, path, f, fi)
 		} else {
-			meta := vac.FileInfoDirEntry(fi)
-			vf, err = vac.NewFile(ctx, bw, f, meta, bsize)
+			vf, err = vacFile(ctx, bw, f, fi)
 		}
 		if err != nil {
 			return nil, err
@@ -1,26 +1,18 @@
 package venti
 
-import (
-	"errors"
-
-	venti "sigint.ca/venti2"
-)
+import venti "sigint.ca/venti2"
 
 type Backend interface {
 	ReadBlock(venti.Score, []byte) (int, error)
 	WriteBlock(typ uint8, data []byte) (venti.Score, error)
 }
 
-var (
-	ENotFound = errors.New("block not found")
-)
-
 type MemBackend map[venti.Score][]byte
 
 func (b MemBackend) ReadBlock(s venti.Score, p []byte) (int, error) {
 	buf, ok := b[s]
 	if !ok {
-		return 0, ENotFound
+		return 0, venti.ErrNotFound
 	}
 	return copy(p, buf), nil
 }
@@ -7,14 +7,29 @@ import (
 	"log"
 	"net"
 	"strings"
+
+	venti "sigint.ca/venti2"
+	"sigint.ca/venti2/internal/rpc"
 )
 
 const VentiPort = 17034
 
+// supportedVersions lists the protocol versions implemented by
+// the server, in order of preference.
 var supportedVersions = []string{
+	"04",
 	"02",
 }
 
+const (
+	rpcPing    = 2
+	rpcHello   = 4
+	rpcGoodbye = 6
+	rpcRead    = 12
+	rpcWrite   = 14
+	rpcSync    = 16
+)
+
 type Server struct {
 	backend Backend
 }
@@ -49,19 +64,23 @@ func (s *Server) Listen(address string) error {
 			continue
 		}
 
-		go func() {
-			c := &conn{
-				server: s,
-				rwc:    rwc,
-				bufr:   bufio.NewReader(rwc),
-				bufw:   bufio.NewWriter(rwc),
-			}
-			defer c.close()
+		go s.ServeConn(rwc)
+	}
+}
 
-			if err := c.serve(); err != nil {
-				log.Printf("serve: %v", err)
-			}
-		}()
+// ServeConn serves a single client connection, and closes it
+// when the client hangs up or an error occurs.
+func (s *Server) ServeConn(rwc net.Conn) {
+	c := &conn{
+		server: s,
+		rwc:    rwc,
+		bufr:   bufio.NewReader(rwc),
+		bufw:   bufio.NewWriter(rwc),
+	}
+	defer c.close()
+
+	if err := c.serve(); err != nil {
+		log.Printf("serve: %v", err)
 	}
 }
 
@@ -70,98 +89,126 @@ func (c *conn) close() error {
 }
 
 func (c *conn) serve() error {
-	return errors.New("not implemented")
-	// if err := c.negotiateVersion(); err != nil {
-	// 	return err
-	// }
-
-	// for {
-	// 	var length uint16
-	// 	if err := binary.Read(c.bufr, binary.BigEndian, &length); err == io.EOF {
-	// 		return nil
-	// 	} else if err != nil {
-	// 		return fmt.Errorf("read length: %v", err)
-	// 	}
-
-	// 	reqBuf := make([]byte, length)
-	// 	if _, err := io.ReadFull(c.bufr, reqBuf); err != nil {
-	// 		return fmt.Errorf("read message: err")
-	// 	}
-	// 	typ := reqBuf[0]
-	// 	tag := reqBuf[1]
-	// 	reqBuf = reqBuf[2:]
-
-	// 	var resp message
-	// 	var err error
-	// 	switch typ {
-	// 	case rpcPing:
-	// 		req := new(pingRequest)
-	// 		if err := req.decode(reqBuf); err != nil {
-	// 			err = fmt.Errorf("server failed to decode request: %v", err)
-	// 			break
-	// 		}
-
-	// 		resp = &pingResponse{}
-
-	// 	case rpcHello:
-	// 		req := new(helloRequest)
-	// 		if err = req.decode(reqBuf); err != nil {
-	// 			err = fmt.Errorf("server failed to decode request: %v", err)
-	// 			break
-	// 		}
-
-	// 		c.version = req.version
-	// 		c.uid = req.uid
-
-	// 		resp = &helloResponse{
-	// 			sid: "foobar",
-	// 		}
-
-	// 	// case rpcGoodbye:
-	// 	// case rpcAuth0:
-	// 	// case rpcAuth1:
-	// 	// case rpcRead:
-	// 	case rpcWrite:
-	// 		req := new(writeRequest)
-	// 		if err := req.decode(reqBuf); err != nil {
-	// 			err = fmt.Errorf("server failed to decode request: %v", err)
-	// 			break
-	// 		}
-
-	// 		log.Printf("server: writing block: %q", req.data)
-	// 		s, err := c.server.backend.WriteBlock(req.typ, req.data)
-	// 		if err != nil {
-	// 			err = fmt.Errorf("server failed to write block: %v", err)
-	// 			break
-	// 		}
-	// 		log.Printf("server: wrote block with score %v", s)
-
-	// 		resp = &writeResponse{
-	// 			score: s,
-	// 		}
-
-	// 	// case rpcSync:
-	// 	default:
-	// 		err = fmt.Errorf("request type not recognized: %d", typ)
-	// 	}
-
-	// 	if err != nil {
-	// 		resp = &errorResponse{err: err}
-	// 	}
-
-	// 	log.Printf("server: encoding response type=%T tag=%d", resp, tag)
-	// 	respBuf := resp.encode(tag)
-
-	// 	var buf bytes.Buffer
-	// 	binary.Write(&buf, binary.BigEndian, uint16(len(respBuf)))
-	// 	buf.Write(respBuf)
-	// 	buf.WriteTo(c.bufw)
-	// 	if err := c.bufw.Flush(); err != nil {
-	// 		return fmt.Errorf("flush response: %v", err)
-	// 	}
-	// }
+	if err := c.negotiateVersion(); err != nil {
+		return err
+	}
+
+	srv := rpc.NewServer(c)
+	return srv.ServeConn(c.bufr, c.rwc, c.bigBlocks())
 }
 
+func (c *conn) bigBlocks() bool {
+	return c.version == "04"
+}
+
+func (c *conn) maxBlockSize() int {
+	if c.bigBlocks() {
+		return venti.MaxBigBlockSize
+	}
+	return venti.MaxBlockSize
+}
+
+func (c *conn) ServeRPC(funcId uint8, d *rpc.Decoder) (rpc.Marshaler, error) {
+	switch funcId {
+	case rpcPing:
+		return rpc.Empty{}, nil
+
+	case rpcHello:
+		version := d.String()
+		c.uid = d.String()
+		d.Uint8()       // strength
+		d.ShortString() // crypto
+		d.ShortString() // codec
+		if err := d.Err(); err != nil {
+			return nil, fmt.Errorf("decode hello: %w", err)
+		}
+		if version != c.version {
+			return nil, fmt.Errorf("hello: version %q does not match negotiated version %q", version, c.version)
+		}
+		return &helloResponse{sid: "sigint.ca/venti"}, nil
+
+	case rpcGoodbye:
+		return nil, rpc.ErrHangup
+
+	case rpcRead:
+		var score venti.Score
+		d.Bytes(score[:])
+		typ := d.Uint8()
+		d.Uint8() // pad
+		var count int
+		if d.Len() == 4 {
+			count = int(d.Uint32())
+		} else {
+			count = int(d.Uint16())
+		}
+		if err := d.Err(); err != nil {
+			return nil, fmt.Errorf("decode read: %w", err)
+		}
+		if count > c.maxBlockSize() {
+			count = c.maxBlockSize()
+		}
+		buf := make([]byte, count)
+		n, err := c.server.backend.ReadBlock(score, buf)
+		if errors.Is(err, venti.ErrNotFound) {
+			// the message recognized by clients, as sent by plan 9 venti
+			return nil, fmt.Errorf("no block with score %v/%d exists", score, typ)
+		} else if err != nil {
+			return nil, err
+		}
+		return dataResponse(buf[:n]), nil
+
+	case rpcWrite:
+		typ := d.Uint8()
+		var pad [3]byte
+		d.Bytes(pad[:])
+		if d.Len() > c.maxBlockSize() {
+			return nil, fmt.Errorf("oversized block: %d > %d", d.Len(), c.maxBlockSize())
+		}
+		data := make([]byte, d.Len())
+		d.Bytes(data)
+		if err := d.Err(); err != nil {
+			return nil, fmt.Errorf("decode write: %w", err)
+		}
+		s, err := c.server.backend.WriteBlock(typ, data)
+		if err != nil {
+			return nil, err
+		}
+		return scoreResponse(s), nil
+
+	case rpcSync:
+		return rpc.Empty{}, nil
+
+	default:
+		return nil, fmt.Errorf("request type not recognized: %d", funcId)
+	}
+}
+
+type helloResponse struct {
+	sid string
+}
+
+func (m *helloResponse) MarshalRPC(buf []byte) ([]byte, error) {
+	buf, err := rpc.AppendString(buf, m.sid)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, 0, 0), nil // rcrypto, rcodec
+}
+
+type dataResponse []byte
+
+func (m dataResponse) MarshalRPC(buf []byte) ([]byte, error) {
+	return append(buf, m...), nil
+}
+
+type scoreResponse venti.Score
+
+func (m scoreResponse) MarshalRPC(buf []byte) ([]byte, error) {
+	return append(buf, m[:]...), nil
+}
+
+// negotiateVersion reads the client's version string and
+// responds with the most preferred version it supports.
 func (c *conn) negotiateVersion() error {
 	vs, err := c.bufr.ReadString('\n')
 	if err != nil {
@@ -180,8 +227,20 @@ func (c *conn) negotiateVersion() error {
 		return fmt.Errorf("bad version string: %q", vs)
 	}
 
-	serverSupported := strings.Join(supportedVersions, ":")
-	vs = fmt.Sprintf("venti-%s-sigint.ca/venti\n", serverSupported)
+outer:
+	for _, v := range supportedVersions {
+		for _, vv := range clientSupported {
+			if v == vv {
+				c.version = v
+				break outer
+			}
+		}
+	}
+	if c.version == "" {
+		return errors.New("failed to negotiate version")
+	}
+
+	vs = fmt.Sprintf("venti-%s-sigint.ca/venti\n", c.version)
 	if _, err := c.bufw.WriteString(vs); err != nil {
 		return err
 	}
@@ -0,0 +1,84 @@
+package venti
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	venti "sigint.ca/venti2"
+)
+
+func dialPipe(t *testing.T, s *Server, opts ...venti.DialOption) *venti.Client {
+	cliConn, srvConn := net.Pipe()
+	go s.ServeConn(srvConn)
+
+	opts = append(opts, venti.WithConn(cliConn))
+	client, err := venti.Dial(context.Background(), "pipe", opts...)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return client
+}
+
+func TestLargeBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewServer(make(MemBackend))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make([]byte, 256*1024)
+	for i := range block {
+		block[i] = byte(i * 7)
+	}
+
+	client := dialPipe(t, s)
+	if v := client.Version(); v != "04" {
+		t.Errorf("negotiated version %q, want 04", v)
+	}
+	score, err := client.WriteBlock(ctx, venti.DataType, block)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(block))
+	n, err := client.ReadBlock(ctx, score, venti.DataType, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], block) {
+		t.Error("read returned different data")
+	}
+	if err := client.Ping(ctx); err != nil {
+		t.Error(err)
+	}
+	client.Close()
+
+	// version 02 is limited to small blocks
+	client = dialPipe(t, s, venti.WithVersions("02"))
+	if v := client.Version(); v != "02" {
+		t.Errorf("negotiated version %q, want 02", v)
+	}
+	if _, err := client.WriteBlock(ctx, venti.DataType, block); err == nil {
+		t.Error("expected error writing large block with version 02")
+	}
+	n, err = client.ReadBlock(ctx, venti.Fingerprint(block[:100]), venti.DataType, buf)
+	if !errors.Is(err, venti.ErrNotFound) {
+		t.Errorf("read missing block: got %v, want %v", err, venti.ErrNotFound)
+	}
+	small := block[:8192]
+	score, err = client.WriteBlock(ctx, venti.DataType, small)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	n, err = client.ReadBlock(ctx, score, venti.DataType, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], small) {
+		t.Error("read returned different data")
+	}
+	client.Close()
+}
@@ -0,0 +1,103 @@
+package venti
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// A ContextDialer dials network connections. It is
+// satisfied by *net.Dialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// A DialOption configures how Dial connects to a venti server.
+type DialOption func(*dialConfig)
+
+type dialConfig struct {
+	uid              string
+	versions         []string
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+	dialer           ContextDialer
+	conn             net.Conn
+	logger           *log.Logger
+	observer         Observer
+}
+
+func defaultDialConfig() dialConfig {
+	return dialConfig{
+		uid:         "foobar",
+		versions:    supportedVersions,
+		idleTimeout: idleTimeout,
+		dialer:      new(net.Dialer),
+	}
+}
+
+// WithUid sets the user name sent to the server in the hello
+// message. The server may use it for logging and quotas.
+// The default is "foobar".
+func WithUid(uid string) DialOption {
+	return func(c *dialConfig) {
+		c.uid = uid
+	}
+}
+
+// WithVersions sets the protocol versions, such as "02", that the
+// client will accept, in order of preference. Versions that the
+// client does not implement are ignored.
+func WithVersions(versions ...string) DialOption {
+	return func(c *dialConfig) {
+		c.versions = nil
+		for _, v := range versions {
+			for _, vv := range supportedVersions {
+				if v == vv {
+					c.versions = append(c.versions, v)
+				}
+			}
+		}
+	}
+}
+
+// WithHandshakeTimeout bounds the time taken to connect, negotiate
+// a protocol version and say hello, in addition to any deadline
+// of the context passed to Dial.
+func WithHandshakeTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.handshakeTimeout = d
+	}
+}
+
+// WithIdleTimeout sets how long the connection may go without
+// any traffic from the server while requests are outstanding
+// before it is considered dead. Zero disables the timeout.
+func WithIdleTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.idleTimeout = d
+	}
+}
+
+// WithDialer sets the dialer used to connect to the server.
+func WithDialer(d ContextDialer) DialOption {
+	return func(c *dialConfig) {
+		c.dialer = d
+	}
+}
+
+// WithConn makes Dial use an established connection, such as one
+// end of a net.Pipe, instead of dialing the address.
+func WithConn(conn net.Conn) DialOption {
+	return func(c *dialConfig) {
+		c.conn = conn
+	}
+}
+
+// WithLogger sets a logger for debugging messages
+// about the connection and each request.
+func WithLogger(l *log.Logger) DialOption {
+	return func(c *dialConfig) {
+		c.logger = l
+	}
+}
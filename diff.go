@@ -0,0 +1,160 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// A Range is a range of bytes of a source.
+type Range struct {
+	Off int64
+	Len int64
+}
+
+// Diff compares the sources described by a and b, and returns the
+// ranges of bytes which differ, in order. Where the two trees hold
+// the same score, the subtrees beneath are identical, and are not
+// read, so the cost of Diff is proportional to the size of the
+// changes rather than of the sources. Data blocks are not read:
+// each block which differs is reported as a whole, up to the size
+// of the shorter source, beyond which everything differs.
+//
+// The sources must have the same block sizes. Their depths may differ.
+func Diff(ctx context.Context, br BlockReader, a, b Entry) ([]Range, error) {
+	if a.Psize != b.Psize || a.Dsize != b.Dsize {
+		return nil, errors.New("diff: block sizes differ")
+	}
+
+	minSize, maxSize := a.Size, b.Size
+	if minSize > maxSize {
+		minSize, maxSize = maxSize, minSize
+	}
+	d := differ{
+		ctx:     ctx,
+		br:      br,
+		a:       &a,
+		b:       &b,
+		fanout:  a.Psize / ScoreSize,
+		minSize: minSize,
+	}
+
+	depth := a.Depth()
+	if b.Depth() > depth {
+		depth = b.Depth()
+	}
+	na := d.top(&a, depth)
+	nb := d.top(&b, depth)
+	if err := d.diff(depth, 0, na, nb); err != nil {
+		return nil, err
+	}
+	if maxSize > minSize {
+		d.add(minSize, maxSize-minSize)
+	}
+	return d.ranges, nil
+}
+
+type differ struct {
+	ctx     context.Context
+	br      BlockReader
+	a, b    *Entry
+	fanout  int
+	minSize int64
+	ranges  []Range
+}
+
+// A diffNode is a block of one of the trees being compared. A
+// virtual node stands for a pointer block above the root of the
+// shallower tree, whose first score is the root, or another virtual
+// node, and whose other scores are zero.
+type diffNode struct {
+	score   Score
+	virtual bool
+}
+
+// top returns the node at the given depth above the root of e.
+func (d *differ) top(e *Entry, depth int) diffNode {
+	if depth > e.Depth() {
+		return diffNode{virtual: true}
+	}
+	return diffNode{score: e.Score}
+}
+
+// diff compares block i at the given level of the two trees,
+// where level 0 is the data blocks, and records the ranges
+// of the data blocks beneath which differ.
+func (d *differ) diff(level int, i int64, na, nb diffNode) error {
+	if !na.virtual && !nb.virtual && na.score == nb.score {
+		return nil
+	}
+	if level == 0 {
+		dsize := int64(d.a.Dsize)
+		off := i * dsize
+		if off >= d.minSize {
+			return nil
+		}
+		n := dsize
+		if off+n > d.minSize {
+			n = d.minSize - off
+		}
+		d.add(off, n)
+		return nil
+	}
+
+	ca, err := d.children(d.a, level, na)
+	if err != nil {
+		return err
+	}
+	cb, err := d.children(d.b, level, nb)
+	if err != nil {
+		return err
+	}
+	for c := range ca {
+		if err := d.diff(level-1, i*int64(d.fanout)+int64(c), ca[c], cb[c]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// children returns the nodes beneath n, a pointer block at the
+// given level of the tree described by e, zero-extended to the
+// full fanout.
+func (d *differ) children(e *Entry, level int, n diffNode) ([]diffNode, error) {
+	nodes := make([]diffNode, d.fanout)
+	zero := ZeroScore()
+	for i := range nodes {
+		nodes[i].score = zero
+	}
+	if n.virtual {
+		nodes[0] = d.top(e, level-1)
+		return nodes, nil
+	}
+	if n.score == zero {
+		return nodes, nil
+	}
+
+	t := e.BaseType() + BlockType(level)
+	buf := make([]byte, e.Psize)
+	m, err := d.br.ReadBlock(d.ctx, n.score, t, buf)
+	if err != nil {
+		return nil, fmt.Errorf("diff: read %v block %v: %w", t, n.score, err)
+	}
+	for i := 0; i < m/ScoreSize; i++ {
+		nodes[i].score = unpackScore(buf, i)
+	}
+	return nodes, nil
+}
+
+// add records that the n bytes at off differ, merging
+// the range with the previous one where they touch.
+func (d *differ) add(off, n int64) {
+	if k := len(d.ranges); k > 0 {
+		last := &d.ranges[k-1]
+		if last.Off+last.Len == off {
+			last.Len += n
+			return
+		}
+	}
+	d.ranges = append(d.ranges, Range{Off: off, Len: n})
+}
@@ -0,0 +1,124 @@
+package venti
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// diffBlocks returns the ranges Diff should report for two sources
+// with the given data, comparing their zero-extended data blocks.
+func diffBlocks(a, b []byte, dsize int) []Range {
+	block := func(data []byte, i int) []byte {
+		buf := make([]byte, dsize)
+		if i*dsize < len(data) {
+			copy(buf, data[i*dsize:])
+		}
+		return buf
+	}
+	min, max := len(a), len(b)
+	if min > max {
+		min, max = max, min
+	}
+
+	var d differ
+	d.minSize = int64(min)
+	for i := 0; i*dsize < min; i++ {
+		if !reflect.DeepEqual(block(a, i), block(b, i)) {
+			n := dsize
+			if i*dsize+n > min {
+				n = min - i*dsize
+			}
+			d.add(int64(i*dsize), int64(n))
+		}
+	}
+	if max > min {
+		d.add(int64(min), int64(max-min))
+	}
+	return d.ranges
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	const psize, dsize = 3 * ScoreSize, 20
+	m := NewMemStore()
+	rnd := rand.New(rand.NewSource(1))
+
+	data := make([]byte, 2000)
+	rnd.Read(data)
+	e := writeSource(t, m, data, psize, dsize)
+
+	for i := 0; i < 50; i++ {
+		ed := NewEditor(ctx, m, m, e)
+		edited := append([]byte(nil), data...)
+		for j := rnd.Intn(4); j >= 0; j-- {
+			p := make([]byte, rnd.Intn(30))
+			rnd.Read(p)
+			off := rnd.Intn(len(edited))
+			if _, err := ed.WriteAt(p, int64(off)); err != nil {
+				t.Fatal(err)
+			}
+			if end := off + len(p); end > len(edited) {
+				edited = append(edited, make([]byte, end-len(edited))...)
+			}
+			copy(edited[off:], p)
+		}
+		switch rnd.Intn(4) {
+		case 0:
+			// grow, possibly deepening the tree
+			p := make([]byte, rnd.Intn(20000))
+			rnd.Read(p)
+			ed.Append(p)
+			edited = append(edited, p...)
+		case 1:
+			size := rnd.Intn(len(edited))
+			ed.Truncate(int64(size))
+			edited = edited[:size]
+		}
+		e2, err := ed.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := diffBlocks(data, edited, dsize)
+		for _, ab := range [][2]Entry{{e, e2}, {e2, e}} {
+			got, err := Diff(ctx, m, ab[0], ab[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("diff %d:\n\twant=%v,\n\t got=%v", i, want, got)
+			}
+		}
+	}
+
+	// identical trees cost nothing
+	cr := &countingReader{BlockReader: m}
+	ranges, err := Diff(ctx, cr, e, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 0 || cr.count() != 0 {
+		t.Errorf("diff of identical trees: %v, %d reads", ranges, cr.count())
+	}
+
+	// one changed block costs one read per level of each tree
+	ed := NewEditor(ctx, m, m, e)
+	ed.WriteAt([]byte("x"), 1234)
+	e2, err := ed.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr = &countingReader{BlockReader: m}
+	ranges, err = Diff(ctx, cr, e, e2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{{1220, 20}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got %v, want %v", ranges, want)
+	}
+	if n := cr.count(); n != 2*e.Depth() {
+		t.Errorf("diff read %d blocks, want %d", n, 2*e.Depth())
+	}
+}
@@ -0,0 +1,293 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// A SourceEditor modifies an existing source, copy-on-write. Writes
+// are buffered as dirty data blocks until Flush, which writes them
+// along with the pointer blocks on their paths to a new root, and
+// reuses every other block of the original tree. The depth of the
+// tree grows or shrinks with the size of the source.
+//
+// The source written by Flush is identical to one written from
+// scratch by a SourceWriter, so the two can be used interchangeably.
+type SourceEditor struct {
+	ctx context.Context
+
+	br BlockReader
+	bw BlockWriter
+	e  Entry     // the tree being edited
+	r  *ReaderAt // reads e, caching its pointer blocks
+
+	size  int64
+	keep  int64            // data blocks of e which are still valid
+	dirty map[int64][]byte // modified data blocks, zero-extended
+}
+
+// NewEditor returns a SourceEditor for the source described by e.
+// A new source may be created by editing an Entry with a Size of
+// zero, and the desired Psize, Dsize and Type.
+func NewEditor(ctx context.Context, br BlockReader, bw BlockWriter, e Entry) *SourceEditor {
+	if e.Dsize <= 0 {
+		panic("bad dsize")
+	}
+	if e.Psize <= 40 {
+		panic("bad psize")
+	}
+	if t := e.BaseType(); t != DataType && t != DirType {
+		panic("bad type")
+	}
+
+	ed := &SourceEditor{
+		ctx: ctx,
+		br:  br,
+		bw:  bw,
+	}
+	ed.reset(e)
+	return ed
+}
+
+func (ed *SourceEditor) reset(e Entry) {
+	ed.e = e
+	ed.r = NewReaderAt(ed.br, e)
+	ed.size = e.Size
+	ed.keep = ed.numBlocks()
+	ed.dirty = make(map[int64][]byte)
+}
+
+// Size returns the current size of the source.
+func (ed *SourceEditor) Size() int64 {
+	return ed.size
+}
+
+func (ed *SourceEditor) numBlocks() int64 {
+	dsize := int64(ed.e.Dsize)
+	return (ed.size + dsize - 1) / dsize
+}
+
+// WriteAt writes p at offset off, extending the source if needed.
+// Writing beyond the end of the source leaves a run of zeros.
+func (ed *SourceEditor) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("write: negative offset")
+	}
+	if max := MaxSize(ed.e.Psize, ed.e.Dsize); int64(len(p)) > max-off {
+		return 0, fmt.Errorf("write: %w: the maximum size is %d", ErrTooLarge, max)
+	}
+
+	var n int
+	dsize := int64(ed.e.Dsize)
+	for len(p) > 0 {
+		b, boff := off/dsize, int(off%dsize)
+		buf, err := ed.load(b)
+		if err != nil {
+			return n, err
+		}
+		m := copy(buf[boff:], p)
+		p = p[m:]
+		n += m
+		off += int64(m)
+		if off > ed.size {
+			ed.size = off
+		}
+	}
+	return n, nil
+}
+
+// Append writes p at the end of the source.
+func (ed *SourceEditor) Append(p []byte) (int, error) {
+	return ed.WriteAt(p, ed.size)
+}
+
+// Truncate changes the size of the source. Growing the
+// source adds a run of zeros.
+func (ed *SourceEditor) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("truncate: negative size")
+	}
+	if max := MaxSize(ed.e.Psize, ed.e.Dsize); size > max {
+		return fmt.Errorf("truncate: %w: the maximum size is %d", ErrTooLarge, max)
+	}
+	if size >= ed.size {
+		ed.size = size
+		return nil
+	}
+
+	ed.size = size
+	nblocks := ed.numBlocks()
+	for b := range ed.dirty {
+		if b >= nblocks {
+			delete(ed.dirty, b)
+		}
+	}
+	if rem := int(size % int64(ed.e.Dsize)); rem != 0 {
+		// zero the tail of the new last block, so that
+		// growing the source again reads zeros
+		buf, err := ed.load(nblocks - 1)
+		if err != nil {
+			return err
+		}
+		memset(buf[rem:], 0)
+	}
+	if nblocks < ed.keep {
+		ed.keep = nblocks
+	}
+	return nil
+}
+
+// load returns the dirty buffer of data block b,
+// reading it from the tree if it is not yet dirty.
+func (ed *SourceEditor) load(b int64) ([]byte, error) {
+	if buf, ok := ed.dirty[b]; ok {
+		return buf, nil
+	}
+	buf := make([]byte, ed.e.Dsize)
+	if b < ed.keep {
+		if _, err := ed.r.readBlock(ed.ctx, b, 0, buf); err != nil {
+			return nil, fmt.Errorf("read block %d: %w", b, err)
+		}
+	}
+	ed.dirty[b] = buf
+	return buf, nil
+}
+
+// Flush writes the dirty data blocks and the pointer blocks above
+// them, and returns an Entry describing the new tree, which is then
+// edited by further calls. If Flush fails, the edits are kept, and
+// Flush may be retried.
+func (ed *SourceEditor) Flush() (Entry, error) {
+	nblocks := ed.numBlocks()
+	fanout := int64(ed.e.Psize / ScoreSize)
+	depth := 0
+	for span := int64(1); span < nblocks; span *= fanout {
+		depth++
+	}
+
+	f := editFlush{
+		SourceEditor: ed,
+		nblocks:      nblocks,
+		oldBlocks:    (ed.e.Size + int64(ed.e.Dsize) - 1) / int64(ed.e.Dsize),
+		fanout:       fanout,
+		dirtyNodes:   make(map[editNode]bool),
+		zeroTrees:    make(map[int]Score),
+	}
+	for b := range ed.dirty {
+		for level := 0; level <= depth; level++ {
+			f.dirtyNodes[editNode{level, b}] = true
+			b /= fanout
+		}
+	}
+
+	score := ZeroScore()
+	if nblocks > 0 {
+		var err error
+		score, err = f.node(depth, 0)
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+
+	e := Entry{
+		Gen:   ed.e.Gen,
+		Psize: ed.e.Psize,
+		Dsize: ed.e.Dsize,
+		Type:  ed.e.BaseType() + BlockType(depth),
+		Flags: ed.e.Flags | EntryActive,
+		Size:  ed.size,
+		Score: score,
+	}
+	ed.reset(e)
+	return e, nil
+}
+
+// An editNode is block i at a level of the tree,
+// where level 0 is the data blocks.
+type editNode struct {
+	level int
+	i     int64
+}
+
+// editFlush holds the state of a call to Flush.
+type editFlush struct {
+	*SourceEditor
+	nblocks    int64
+	oldBlocks  int64 // data blocks in the old tree
+	fanout     int64
+	dirtyNodes map[editNode]bool // nodes with dirty data blocks beneath
+	zeroTrees  map[int]Score     // full all-zero subtrees, by level
+}
+
+// node returns the score of block i at the given level of the new
+// tree, reusing the old block when its subtree is unchanged, and
+// otherwise writing it.
+func (f *editFlush) node(level int, i int64) (Score, error) {
+	span := int64(1)
+	for l := 0; l < level; l++ {
+		span *= f.fanout
+	}
+	start := i * span
+	end := start + span
+	full := end <= f.nblocks
+	if !full {
+		end = f.nblocks
+	}
+
+	if !f.dirtyNodes[editNode{level, i}] {
+		// an unchanged subtree of the same shape
+		if end <= f.keep && (full || end == f.keep && f.keep == f.oldBlocks) && level <= f.e.Depth() {
+			s, err := f.r.nodeScore(f.ctx, level, i)
+			if err != nil {
+				return Score{}, fmt.Errorf("read pointers: %w", err)
+			}
+			return s, nil
+		}
+		if start >= f.keep && full {
+			if s, ok := f.zeroTrees[level]; ok {
+				return s, nil
+			}
+		}
+	}
+
+	if level == 0 {
+		buf, ok := f.dirty[i]
+		if !ok {
+			// beyond the old tree: zeros
+			return ZeroScore(), nil
+		}
+		t := f.e.BaseType()
+		return f.writeBlock(ZeroTruncate(t, buf), t)
+	}
+
+	cspan := span / f.fanout
+	nchild := (end - start + cspan - 1) / cspan
+	block := make([]byte, 0, nchild*ScoreSize)
+	for c := int64(0); c < nchild; c++ {
+		s, err := f.node(level-1, i*f.fanout+c)
+		if err != nil {
+			return Score{}, err
+		}
+		block = append(block, s.Bytes()...)
+	}
+	s, err := f.writeBlock(block, f.e.BaseType()+BlockType(level))
+	if err != nil {
+		return Score{}, err
+	}
+	if start >= f.keep && full && !f.dirtyNodes[editNode{level, i}] {
+		f.zeroTrees[level] = s
+	}
+	return s, nil
+}
+
+func (f *editFlush) writeBlock(block []byte, t BlockType) (Score, error) {
+	if len(block) == 0 {
+		return ZeroScore(), nil
+	}
+	s, err := f.bw.WriteBlock(f.ctx, t, block)
+	if err != nil {
+		return Score{}, fmt.Errorf("write %v block: %w", t, err)
+	}
+	return s, nil
+}
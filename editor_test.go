@@ -0,0 +1,189 @@
+package venti
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// countingWriter counts the blocks written through it.
+type countingWriter struct {
+	BlockWriter
+	n int
+}
+
+func (w *countingWriter) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
+	w.n++
+	return w.BlockWriter.WriteBlock(ctx, t, buf)
+}
+
+func TestSourceEditor(t *testing.T) {
+	ctx := context.Background()
+	const psize, dsize = 3 * ScoreSize, 20
+	m := NewMemStore()
+	rnd := rand.New(rand.NewSource(1))
+
+	data := make([]byte, 300)
+	rnd.Read(data)
+	e := writeSource(t, m, data, psize, dsize)
+	ed := NewEditor(ctx, m, m, e)
+
+	for i := 0; i < 200; i++ {
+		switch op := rnd.Intn(4); op {
+		case 0, 1:
+			// overwrite, or write past the end
+			off := rnd.Intn(len(data) + 50)
+			p := make([]byte, rnd.Intn(70))
+			if rnd.Intn(4) > 0 {
+				rnd.Read(p)
+			}
+			if _, err := ed.WriteAt(p, int64(off)); err != nil {
+				t.Fatal(err)
+			}
+			if end := off + len(p); end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			copy(data[off:], p)
+		case 2:
+			p := make([]byte, rnd.Intn(100))
+			rnd.Read(p)
+			if _, err := ed.Append(p); err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, p...)
+		case 3:
+			size := rnd.Intn(len(data) + 100)
+			if err := ed.Truncate(int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			if size < len(data) {
+				data = data[:size]
+			} else {
+				data = append(data, make([]byte, size-len(data))...)
+			}
+		}
+		if ed.Size() != int64(len(data)) {
+			t.Fatalf("op %d: got size %d, want %d", i, ed.Size(), len(data))
+		}
+		if rnd.Intn(3) > 0 {
+			continue
+		}
+
+		e, err := ed.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := writeSource(t, NewMemStore(), data, psize, dsize); e != want {
+			t.Fatalf("op %d: edited entry differs from written:\n\twant=%+v,\n\t got=%+v", i, want, e)
+		}
+		got, err := io.ReadAll(NewReader(ctx, m, e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("op %d: bad data:\n\twant=%v,\n\t got=%v", i, data, got)
+		}
+	}
+}
+
+func TestSourceEditorCopyOnWrite(t *testing.T) {
+	ctx := context.Background()
+	const psize, dsize = 4 * ScoreSize, 20
+	m := NewMemStore()
+
+	data := testData(64 * dsize)
+	orig := append([]byte(nil), data...)
+	e := writeSource(t, m, data, psize, dsize)
+	if e.Depth() != 3 {
+		t.Fatalf("bad depth: %d", e.Depth())
+	}
+
+	// one changed block rewrites one path to the root
+	cw := &countingWriter{BlockWriter: m}
+	ed := NewEditor(ctx, m, cw, e)
+	if _, err := ed.WriteAt([]byte("edit"), 700); err != nil {
+		t.Fatal(err)
+	}
+	e1, err := ed.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw.n != e.Depth()+1 {
+		t.Errorf("edit wrote %d blocks, want %d", cw.n, e.Depth()+1)
+	}
+	got, err := io.ReadAll(NewReader(ctx, m, e1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[700:], "edit")
+	if !bytes.Equal(got, data) {
+		t.Errorf("bad data after edit")
+	}
+
+	// growing adds a level above the old root
+	cw.n = 0
+	if _, err := ed.Append([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	e2, err := ed.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2.Depth() != 4 {
+		t.Errorf("bad depth after append: %d", e2.Depth())
+	}
+	if cw.n != e2.Depth()+1 {
+		t.Errorf("append wrote %d blocks, want %d", cw.n, e2.Depth()+1)
+	}
+
+	// shrinking reuses a subtree as the root
+	cw.n = 0
+	if err := ed.Truncate(16 * dsize); err != nil {
+		t.Fatal(err)
+	}
+	e3, err := ed.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e3.Depth() != 2 || cw.n != 0 {
+		t.Errorf("truncate: depth %d, %d blocks written", e3.Depth(), cw.n)
+	}
+	if want := writeSource(t, NewMemStore(), data[:16*dsize], psize, dsize); e3 != want {
+		t.Errorf("truncated entry differs from written:\n\twant=%+v,\n\t got=%+v", want, e3)
+	}
+
+	// the original tree is unchanged
+	got, err = io.ReadAll(NewReader(ctx, m, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, orig) {
+		t.Errorf("original source was modified")
+	}
+}
+
+func TestSourceEditorLimits(t *testing.T) {
+	m := NewMemStore()
+	e := writeSource(t, m, []byte("hello"), 3*ScoreSize, 20)
+	ed := NewEditor(context.Background(), m, m, e)
+	max := MaxSize(e.Psize, e.Dsize)
+	if _, err := ed.WriteAt([]byte("x"), max); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("WriteAt beyond MaxSize: got %v, want ErrTooLarge", err)
+	}
+	if err := ed.Truncate(max + 1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Truncate beyond MaxSize: got %v, want ErrTooLarge", err)
+	}
+	if err := ed.Truncate(max); err != nil {
+		t.Fatal(err)
+	}
+	e, err := ed.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != max || e.Depth() != MaxDepth {
+		t.Errorf("got size %d and depth %d, want %d and %d", e.Size, e.Depth(), max, MaxDepth)
+	}
+}
@@ -20,6 +20,13 @@ const (
 	EntryLocal      uint8 = 1 << 5
 	EntryBig        uint8 = 1 << 6
 	EntryNoArchive  uint8 = 1 << 7
+
+	// MaxDepth is the greatest depth of a tree, as limited
+	// by the bits of the depth in an Entry and a BlockType.
+	MaxDepth = int(typeDepthMask)
+
+	// maxEntrySize is the greatest size stored in an Entry's 48 bits.
+	maxEntrySize = 1<<48 - 1
 )
 
 // TODO: methods and private
@@ -56,6 +63,15 @@ func (e Entry) Pack(p []byte) error {
 	if e.Type-BlockType(e.Depth()) == DirType {
 		flags |= EntryDir
 	}
+	if e.Size < 0 || e.Size > maxEntrySize {
+		return fmt.Errorf("bad entry size: %d", e.Size)
+	}
+	if e.Flags&EntryActive != 0 && e.Psize >= ScoreSize {
+		if max := treeSize(e.Psize, e.Dsize, e.Depth()); e.Size > max {
+			return fmt.Errorf("entry size %d exceeds %d, the capacity of a depth %d tree", e.Size, max, e.Depth())
+		}
+	}
+
 	binary.Write(w, binary.BigEndian, uint32(e.Gen))
 	pshort := uint16(e.Psize)
 	dshort := uint16(e.Dsize)
@@ -125,6 +141,9 @@ func UnpackEntry(p []byte) (Entry, error) {
 	if err := checkBlockSize(e.Dsize); err != nil {
 		return Entry{}, err
 	}
+	if max := treeSize(e.Psize, e.Dsize, e.Depth()); e.Size > max {
+		return Entry{}, fmt.Errorf("entry size %d exceeds %d, the capacity of a depth %d tree", e.Size, max, e.Depth())
+	}
 
 	if r.Len() > 0 {
 		panic(fmt.Sprintf("bytes remaining: %d", r.Len()))
@@ -147,3 +166,41 @@ func checkBlockSize(n int) error {
 	}
 	return nil
 }
+
+// PointerSize returns the largest pointer block size no larger
+// than dsize which holds a whole number of scores and can be
+// stored in an Entry alongside dsize.
+func PointerSize(dsize int) int {
+	psize := dsize - dsize%ScoreSize
+	for psize > math.MaxUint16 {
+		if _, err := intToBig(psize); err == nil {
+			break
+		}
+		psize -= ScoreSize
+	}
+	return psize
+}
+
+// MaxSize returns the largest size of a source with the given block
+// sizes: the capacity of a tree of MaxDepth, or the largest size an
+// Entry can hold, whichever is smaller.
+func MaxSize(psize, dsize int) int64 {
+	return treeSize(psize, dsize, MaxDepth)
+}
+
+// treeSize returns the capacity of a tree of the given depth,
+// capped at the largest size an Entry can hold.
+func treeSize(psize, dsize, depth int) int64 {
+	n := int64(dsize)
+	fanout := int64(psize / ScoreSize)
+	for i := 0; i < depth; i++ {
+		if n > maxEntrySize/fanout {
+			return maxEntrySize
+		}
+		n *= fanout
+	}
+	if n > maxEntrySize {
+		n = maxEntrySize
+	}
+	return n
+}
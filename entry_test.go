@@ -74,3 +74,125 @@ func BenchmarkUnpackEntry(b *testing.B) {
 		}
 	}
 }
+
+func TestPackBigEntry(t *testing.T) {
+	for _, dsize := range []int{56 * 1024, 128 * 1024, MaxBigBlockSize} {
+		e := Entry{
+			Psize: PointerSize(dsize),
+			Dsize: dsize,
+			Type:  DataType + 2,
+			Flags: EntryActive,
+			Size:  12345678,
+			Score: ZeroScore(),
+		}
+		if e.Psize%ScoreSize != 0 || e.Psize > dsize {
+			t.Errorf("dsize=%d: bad pointer size %d", dsize, e.Psize)
+		}
+
+		buf := make([]byte, EntrySize)
+		if err := e.Pack(buf); err != nil {
+			t.Fatalf("dsize=%d: %v", dsize, err)
+		}
+		ee, err := UnpackEntry(buf)
+		if err != nil {
+			t.Fatalf("dsize=%d: %v", dsize, err)
+		}
+		if ee != e {
+			t.Errorf("results differ: \n%v\n\tvs\n%v", e, ee)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	tests := []struct {
+		psize, dsize int
+		want         int64
+	}{
+		{3 * ScoreSize, 20, 20 * 3 * 3 * 3 * 3 * 3 * 3 * 3},
+		{10 * ScoreSize, 256, 256 * 10000000},
+		{DefaultPointerSize, DefaultDataSize, 1<<48 - 1},
+		{PointerSize(MaxBigBlockSize), MaxBigBlockSize, 1<<48 - 1},
+	}
+	for _, test := range tests {
+		if got := MaxSize(test.psize, test.dsize); got != test.want {
+			t.Errorf("MaxSize(%d, %d) = %d, want %d", test.psize, test.dsize, got, test.want)
+		}
+	}
+}
+
+func TestPackEntryLimits(t *testing.T) {
+	buf := make([]byte, EntrySize)
+	e := Entry{
+		Psize: 3 * ScoreSize,
+		Dsize: 20,
+		Flags: EntryActive,
+		Score: ZeroScore(),
+	}
+	max := int64(20)
+	for depth := 0; depth <= MaxDepth; depth++ {
+		e.Type = DataType + BlockType(depth)
+		e.Size = max
+		if err := e.Pack(buf); err != nil {
+			t.Errorf("depth %d, size %d: %v", depth, e.Size, err)
+		}
+		e.Size = max + 1
+		if err := e.Pack(buf); err == nil {
+			t.Errorf("depth %d, size %d: packed entry beyond the tree's capacity", depth, e.Size)
+		} else {
+			t.Logf("%v (expected)", err)
+		}
+		max *= 3
+	}
+
+	e = Entry{
+		Psize: DefaultPointerSize,
+		Dsize: DefaultDataSize,
+		Type:  DataType + BlockType(MaxDepth),
+		Flags: EntryActive,
+		Size:  1<<48 - 1,
+		Score: ZeroScore(),
+	}
+	if err := e.Pack(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{1 << 48, -1} {
+		e.Size = size
+		if err := e.Pack(buf); err == nil {
+			t.Errorf("size %d: packed entry with a bad size", size)
+		} else {
+			t.Logf("%v (expected)", err)
+		}
+	}
+}
+
+func TestUnpackEntryLimits(t *testing.T) {
+	buf := make([]byte, EntrySize)
+	e := Entry{
+		Psize: 13 * ScoreSize,
+		Dsize: 256,
+		Type:  DataType + 1,
+		Flags: EntryActive,
+		Size:  13 * 256,
+		Score: ZeroScore(),
+	}
+	if err := e.Pack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnpackEntry(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pack checks active entries only, so corrupt
+	// the flags of an inactive one
+	e.Flags = 0
+	e.Size++
+	if err := e.Pack(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf[8] |= EntryActive
+	if _, err := UnpackEntry(buf); err == nil {
+		t.Error("unpacked entry beyond the tree's capacity")
+	} else {
+		t.Logf("%v (expected)", err)
+	}
+}
@@ -0,0 +1,65 @@
+package venti
+
+import (
+	"errors"
+	"strings"
+
+	"sigint.ca/venti2/internal/rpc"
+)
+
+var (
+	// ErrNotFound is returned when a block with the requested
+	// score and type does not exist.
+	ErrNotFound = errors.New("block not found")
+
+	// ErrBadType is returned when a block type is invalid.
+	ErrBadType = errors.New("bad block type")
+
+	// ErrTooLarge is returned when a source would grow beyond the
+	// largest size which its tree or Entry can describe.
+	ErrTooLarge = errors.New("source too large")
+)
+
+// A ServerError is an error message returned by a venti server.
+// If the message is recognized, the ServerError wraps the
+// corresponding error, such as ErrNotFound.
+type ServerError struct {
+	Msg string
+	Err error // nil if the message is not recognized
+}
+
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// serverErrors maps the messages sent by venti servers,
+// including plan 9 venti, to errors.
+var serverErrors = []struct {
+	substr string
+	err    error
+}{
+	{"no block with score", ErrNotFound},
+	{"bad block type", ErrBadType},
+	{"invalid block type", ErrBadType},
+}
+
+// serverError converts an error message received from a server to
+// a ServerError. Other errors are returned unchanged.
+func serverError(err error) error {
+	var serr rpc.ServerError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	e := &ServerError{Msg: serr.Err}
+	for _, m := range serverErrors {
+		if strings.Contains(serr.Err, m.substr) {
+			e.Err = m.err
+			break
+		}
+	}
+	return e
+}
@@ -0,0 +1,41 @@
+package venti
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"sigint.ca/venti2/internal/rpc"
+)
+
+func TestServerError(t *testing.T) {
+	for _, test := range []struct {
+		msg  string
+		want error
+	}{
+		{"no block with score da39a3ee5e6b4b0d3255bfef95601890afd80709/13 exists", ErrNotFound},
+		{"bad block type 99", ErrBadType},
+		{"disk is on fire", nil},
+	} {
+		err := fmt.Errorf("read: %w", serverError(rpc.ServerError{Err: test.msg}))
+		var serr *ServerError
+		if !errors.As(err, &serr) {
+			t.Errorf("%q: not a ServerError: %v", test.msg, err)
+			continue
+		}
+		if serr.Msg != test.msg {
+			t.Errorf("got message %q, want %q", serr.Msg, test.msg)
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%q: got %v, want %v", test.msg, err, test.want)
+		}
+		if test.want == nil && (errors.Is(err, ErrNotFound) || errors.Is(err, ErrBadType)) {
+			t.Errorf("%q: unexpectedly matched a sentinel error", test.msg)
+		}
+	}
+
+	other := errors.New("connection reset")
+	if err := serverError(other); err != other {
+		t.Errorf("got %v, want %v", err, other)
+	}
+}
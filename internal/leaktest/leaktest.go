@@ -0,0 +1,29 @@
+// Package leaktest checks that tests don't leak goroutines.
+package leaktest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Check returns a function that reports an error if the number
+// of goroutines has not returned to its current value, waiting
+// a second for goroutines which are exiting. It is typically
+// deferred at the start of a test:
+//
+//	defer leaktest.Check(t)()
+func Check(t testing.TB) func() {
+	n := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		var m int
+		for i := 0; i < 100; i++ {
+			if m = runtime.NumGoroutine(); m <= n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("leaked %d goroutines", m-n)
+	}
+}
@@ -1,10 +1,10 @@
 package rpc
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 	"time"
@@ -12,142 +12,419 @@ import (
 
 type Client struct {
 	conn net.Conn
+	bufr *bufio.Reader
+
+	// dec decodes each response from bufr in turn
+	dec Decoder
+
+	// idleTimeout bounds how long the connection may go without
+	// any traffic while calls are outstanding.
+	idleTimeout time.Duration
+
+	logf func(format string, args ...interface{})
+	obs  Observer
+
+	// long is set if messages have 32-bit lengths
+	long bool
+
+	// wmu serializes writes to conn
+	wmu sync.Mutex
 
 	tags chan uint8
 
-	pendingCond *sync.Cond
-	pending     map[uint8]*call
+	// pending holds the calls waiting for a response, keyed by tag.
+	// This includes abandoned calls, whose tags are quarantined
+	// until the server's response arrives.
+	mu      sync.Mutex
+	pending map[uint8]*call
+
+	// busySince is the time pending last became non-empty.
+	busySince time.Time
 
-	errmu sync.RWMutex
-	err   error
+	// closed is closed when the connection is torn down,
+	// after which err is set.
+	closed chan struct{}
+	done   chan struct{}
+	err    error
 }
 
 type call struct {
-	msg  interface{}
-	done chan error
-	ctx  context.Context
+	funcId uint8
+	msg    Unmarshaler
+	done   chan error
+
+	// respSize is the size of the response body, set before
+	// the result is sent on done.
+	respSize int
+
+	// abandoned is set when the caller gave up waiting
+	// for the response.
+	abandoned bool
 }
 
-func NewClient(conn net.Conn) *Client {
+// Config holds optional client settings.
+type Config struct {
+	// IdleTimeout bounds how long the connection may go without any
+	// response traffic while calls are outstanding, or without a
+	// write making progress. Zero disables this check.
+	IdleTimeout time.Duration
+
+	// Logf, if set, is called with debugging messages.
+	Logf func(format string, args ...interface{})
+
+	// LongMessages selects 32-bit message lengths, as used
+	// by venti protocol version 04, instead of 16-bit lengths.
+	LongMessages bool
+
+	// Observer, if set, is notified of the start and
+	// end of each call.
+	Observer Observer
+}
+
+// CallInfo describes a call for an Observer.
+type CallInfo struct {
+	FuncId uint8
+	Tag    uint8
+
+	// ReqSize is the size of the encoded request, including
+	// the message header.
+	ReqSize int
+
+	// RespSize is the size of the response body. It is
+	// only set at the end of a successful call.
+	RespSize int
+
+	Start   time.Time
+	Latency time.Duration // set at the end of the call
+	Err     error         // set at the end of the call
+}
+
+// An Observer is notified of the start and end of each call.
+// Its methods are called synchronously by the calling goroutine,
+// possibly concurrently, and should return quickly.
+type Observer interface {
+	CallStart(info CallInfo)
+	CallEnd(info CallInfo)
+}
+
+// NewClient returns a client which issues calls over conn.
+// Each call is bounded only by its own context; the connection
+// itself fails only as determined by cfg.IdleTimeout.
+func NewClient(conn net.Conn, cfg Config) *Client {
 	c := &Client{
-		conn: conn,
+		conn:        conn,
+		bufr:        bufio.NewReader(conn),
+		idleTimeout: cfg.IdleTimeout,
+		logf:        cfg.Logf,
+		obs:         cfg.Observer,
+		long:        cfg.LongMessages,
+		tags:        newTagPool(),
 
-		pendingCond: sync.NewCond(&sync.Mutex{}),
-		pending:     make(map[uint8]*call),
+		pending: make(map[uint8]*call),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 
+	c.dec.r = c.bufr
+
 	go c.readResponses()
 
 	return c
 }
 
-func (c *Client) Call(ctx context.Context, funcId uint8, req, resp interface{}) error {
-	if err := c.getErr(); err != nil {
-		return fmt.Errorf("rpc client closed due to error: %v", err)
+// Call sends req to the server and decodes the response into resp.
+// The response is decoded directly from the connection, so resp
+// must not be used by other goroutines until Call returns.
+func (c *Client) Call(ctx context.Context, funcId uint8, req Marshaler, resp Unmarshaler) (err error) {
+	tag, err := c.acquireTag(ctx)
+	if err != nil {
+		return err
 	}
 
-	tag := c.aqcuireTag()
-	defer c.releaseTag(tag)
+	bufp := encodeBufPool.Get().(*[]byte)
+	defer encodeBufPool.Put(bufp)
+	encoded, err := encode((*bufp)[:0], req, funcId, tag, c.long)
+	if err != nil {
+		c.releaseTag(tag)
+		return fmt.Errorf("encode message: %w", err)
+	}
+	*bufp = encoded
 
-	if deadline, ok := ctx.Deadline(); ok {
-		if err := c.conn.SetDeadline(deadline); err != nil {
-			return err
+	// The call is registered before the request is sent, so that
+	// a response with an unknown tag is always a protocol error.
+	call := &call{
+		funcId: funcId,
+		msg:    resp,
+		done:   make(chan error, 1),
+	}
+
+	if c.obs != nil {
+		info := CallInfo{
+			FuncId:  funcId,
+			Tag:     tag,
+			ReqSize: len(encoded),
+			Start:   time.Now(),
 		}
-	} else {
-		c.conn.SetDeadline(time.Time{})
+		c.obs.CallStart(info)
+		defer func() {
+			info.Latency = time.Since(info.Start)
+			if err == nil {
+				info.RespSize = call.respSize
+			}
+			info.Err = err
+			c.obs.CallEnd(info)
+		}()
 	}
 
-	encoded, err := encode(req, funcId, tag)
-	if err != nil {
-		return fmt.Errorf("encode message: %v", err)
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		c.releaseTag(tag)
+		return c.closedErr()
+	default:
 	}
-	if _, err := c.conn.Write(encoded); err != nil {
-		return fmt.Errorf("send message: %v", err)
+	if len(c.pending) == 0 {
+		c.busySince = time.Now()
 	}
+	c.pending[tag] = call
+	c.mu.Unlock()
 
-	done := make(chan error, 1)
-	c.pendingCond.L.Lock()
-	c.pending[tag] = &call{
-		msg:  resp,
-		done: done,
-		ctx:  ctx,
+	if err := c.write(encoded); err != nil {
+		// the connection is being torn down, which
+		// fails all pending calls including this one.
+		<-call.done
+		c.releaseTag(tag)
+		return fmt.Errorf("send message: %w", err)
 	}
-	c.pendingCond.Signal()
-	c.pendingCond.L.Unlock()
+
+	c.debugf("call: func=%d tag=%d size=%d", funcId, tag, len(encoded))
 
 	select {
-	case err = <-done:
+	case err := <-call.done:
+		c.releaseTag(tag)
+		if err != nil {
+			c.debugf("call: func=%d tag=%d: %v", funcId, tag, err)
+		}
+		return err
 	case <-ctx.Done():
-		err = ctx.Err()
 	}
 
-	c.pendingCond.L.Lock()
-	delete(c.pending, tag)
-	c.pendingCond.L.Unlock()
+	c.mu.Lock()
+	if c.pending[tag] != call {
+		// The response is already being decoded into resp,
+		// so we must wait for it to finish.
+		c.mu.Unlock()
+		err := <-call.done
+		c.releaseTag(tag)
+		return err
+	}
+	// Quarantine the tag: it is released when the response
+	// arrives, so it cannot be matched to a later call.
+	call.abandoned = true
+	c.mu.Unlock()
+
+	c.debugf("call: func=%d tag=%d: %v; tag quarantined", funcId, tag, ctx.Err())
+	return ctx.Err()
+}
 
+// Send sends a message to which the server is not expected
+// to respond, such as a venti goodbye. The message is sent with
+// a free tag, so that it cannot be mistaken for an outstanding
+// call; if none is free, Send fails rather than waiting for one.
+func (c *Client) Send(funcId uint8, req Marshaler) error {
+	var tag uint8
+	select {
+	case tag = <-c.tags:
+	default:
+		return errors.New("send message: no free tag")
+	}
+	defer c.releaseTag(tag)
+
+	encoded, err := encode(nil, req, funcId, tag, c.long)
+	if err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+	if err := c.write(encoded); err != nil {
+		return fmt.Errorf("send message: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection, failing any outstanding calls,
+// and waits for the client's goroutines to exit. It is not an
+// error if the connection was already closed, such as by the
+// client's teardown after the server hung up.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
 	return err
 }
 
-const maxResponse = 64 * 1024
+// write sends a complete message. A failed or partial write leaves
+// the stream in an unknown state, so it is fatal to the connection.
+func (c *Client) write(msg []byte) error {
+	select {
+	case <-c.closed:
+		return c.closedErr()
+	default:
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 
-var responseBufPool = sync.Pool{
+	if c.idleTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.idleTimeout))
+	}
+	if _, err := c.conn.Write(msg); err != nil {
+		// closing the connection wakes readResponses,
+		// which tears down the client.
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// encodeBufPool holds buffers for encoding requests,
+// which are usually about the size of a block.
+var encodeBufPool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, maxResponse)
+		buf := make([]byte, 0, 8*1024)
+		return &buf
 	},
 }
 
 func (c *Client) readResponses() {
+	defer close(c.done)
+
+	var err error
 	for {
-		var length uint16
-		if err := binary.Read(c.conn, binary.BigEndian, &length); err != nil {
-			c.setErr(err)
+		if err = c.awaitTraffic(); err != nil {
+			break
+		}
+
+		funcId, tag, rerr := c.dec.readHeader(c.long)
+		if rerr != nil {
+			err = rerr
 			break
 		}
-		buf := responseBufPool.Get().([]byte)[0:length]
-		if _, err := io.ReadFull(c.conn, buf); err != nil {
-			c.setErr(err)
+		if err = c.dispatch(funcId, tag, &c.dec); err != nil {
 			break
 		}
+	}
 
-		go func(buf []byte) {
-			defer responseBufPool.Put(buf)
-
-			// Find the rpc call waiting for this message
-			tag := buf[1]
-			var ok bool
-			var call *call
-			c.pendingCond.L.Lock()
-			for !ok {
-				if call, ok = c.pending[tag]; !ok {
-					c.pendingCond.Wait()
-					continue
-				}
-			}
-			c.pendingCond.L.Unlock()
-
-			select {
-			case <-call.ctx.Done():
-			default:
-				var err ServerError
-				if buf[0] == rpcError {
-					call.done <- decode(&err, buf[2:])
-				} else {
-					call.done <- decode(call.msg, buf[2:])
-				}
-			}
-		}(buf)
+	c.teardown(err)
+}
+
+// dispatch decodes a response and delivers it to the call waiting for
+// it. An error is returned only if the response violates the protocol
+// or cannot be read, leaving the stream in an unknown state.
+func (c *Client) dispatch(funcId, tag uint8, d *Decoder) error {
+	c.mu.Lock()
+	call, ok := c.pending[tag]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("response with unknown tag %d", tag)
 	}
-	c.conn.Close()
+	if funcId != rpcError && funcId != call.funcId+1 {
+		c.mu.Unlock()
+		return fmt.Errorf("bad response type %d to request type %d", funcId, call.funcId)
+	}
+	delete(c.pending, tag)
+	c.mu.Unlock()
+	call.respSize = d.Len()
+	if call.abandoned {
+		// the reply to a cancelled call: discard it and
+		// lift the quarantine on its tag.
+		d.discard()
+		c.releaseTag(tag)
+		return d.ioerr
+	}
+
+	var err error
+	if funcId == rpcError {
+		var serr ServerError
+		if err = serr.UnmarshalRPC(d); err != nil {
+			err = fmt.Errorf("decode error response: %w", err)
+		} else {
+			err = serr
+		}
+	} else if err = call.msg.UnmarshalRPC(d); err != nil {
+		err = fmt.Errorf("decode response: %w", err)
+	}
+	d.discard()
+	if d.ioerr != nil {
+		call.done <- d.ioerr
+		return d.ioerr
+	}
+	call.done <- err
+	return nil
 }
 
-func (c *Client) setErr(err error) {
-	c.errmu.Lock()
-	defer c.errmu.Unlock()
+// teardown closes the connection and fails all outstanding calls.
+func (c *Client) teardown(err error) {
+	c.debugf("closing connection: %v", err)
+	c.conn.Close()
+
+	c.mu.Lock()
 	c.err = err
+	close(c.closed)
+	for tag, call := range c.pending {
+		if !call.abandoned {
+			call.done <- c.closedErr()
+		}
+		delete(c.pending, tag)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) debugf(format string, args ...interface{}) {
+	if c.logf != nil {
+		c.logf("rpc: "+format, args...)
+	}
 }
 
-func (c *Client) getErr() error {
-	c.errmu.RLock()
-	defer c.errmu.RUnlock()
-	return c.err
+func (c *Client) closedErr() error {
+	return fmt.Errorf("rpc client closed due to error: %w", c.err)
+}
+
+// awaitTraffic blocks until the start of the next message is
+// available, and arranges for the rest of the message to arrive
+// within the idle timeout. Silence from the server is only an error
+// while calls are waiting for a response, and is measured from the
+// later of the last traffic and the time those calls began waiting.
+func (c *Client) awaitTraffic() error {
+	if c.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+	for {
+		// Peek does not consume any input, so a timeout here
+		// leaves the stream intact.
+		_, err := c.bufr.Peek(1)
+		if err == nil {
+			return nil
+		}
+		var nerr net.Error
+		if !errors.As(err, &nerr) || !nerr.Timeout() {
+			return err
+		}
+
+		c.mu.Lock()
+		idle := len(c.pending) == 0
+		busySince := c.busySince
+		c.mu.Unlock()
+		if idle {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+			continue
+		}
+		if deadline := busySince.Add(c.idleTimeout); time.Now().Before(deadline) {
+			// the calls were sent during the silence
+			c.conn.SetReadDeadline(deadline)
+			continue
+		}
+		return fmt.Errorf("no response for %v: %w", c.idleTimeout, err)
+	}
 }
@@ -1 +1,373 @@
 package rpc_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"sigint.ca/venti2/internal/leaktest"
+	"sigint.ca/venti2/internal/rpc"
+)
+
+// fakeServer reads requests from conn and passes their function
+// id and tag to handle, which may write arbitrary responses.
+func fakeServer(t *testing.T, conn net.Conn, handle func(w io.Writer, id, tag uint8)) {
+	t.Helper()
+	fakeServerBody(t, conn, func(w io.Writer, id, tag uint8, body []byte) {
+		handle(w, id, tag)
+	})
+}
+
+// fakeServerBody is like fakeServer, but also passes
+// the body of each request to handle.
+func fakeServerBody(t *testing.T, conn net.Conn, handle func(w io.Writer, id, tag uint8, body []byte)) {
+	t.Helper()
+	go func() {
+		defer conn.Close()
+		for {
+			var length uint16
+			if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+				return
+			}
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			handle(conn, buf[0], buf[1], buf[2:])
+		}
+	}()
+}
+
+func writeFrame(w io.Writer, frame ...byte) {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(frame)))
+	w.Write(append(buf, frame...))
+}
+
+func TestCallDeadlines(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	fakeServer(t, srvConn, func(w io.Writer, id, tag uint8) {
+		// respond to the slow call after a delay, and
+		// never respond to the other calls.
+		if id == 10 {
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				writeFrame(w, id+1, tag)
+			}()
+		}
+	})
+
+	c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: time.Second})
+	defer cliConn.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{})
+	}()
+
+	// A call with a short deadline must not affect the
+	// outstanding call without a deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Call(ctx, 20, rpc.Empty{}, rpc.Empty{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("short call: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("slow call: %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	fakeServer(t, srvConn, func(w io.Writer, id, tag uint8) {})
+
+	c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: 50 * time.Millisecond})
+	defer cliConn.Close()
+
+	// an idle connection with no outstanding calls stays up
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	err := c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("call took %v to fail", d)
+	}
+	t.Logf("%v (expected)", err)
+}
+
+// TestIdleTimeoutFromCall checks that the idle timeout counts from
+// when a call was sent, not from the last traffic before it.
+func TestIdleTimeoutFromCall(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	fakeServer(t, srvConn, func(w io.Writer, id, tag uint8) {
+		go func() {
+			time.Sleep(60 * time.Millisecond)
+			writeFrame(w, id+1, tag)
+		}()
+	})
+
+	c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: 200 * time.Millisecond})
+	defer cliConn.Close()
+
+	time.Sleep(170 * time.Millisecond)
+	if err := c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSendTag checks that Send does not reuse the tag
+// of an outstanding call.
+func TestSendTag(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	var callTag uint8
+	called := make(chan struct{})
+	sendTag := make(chan uint8, 1)
+	fakeServer(t, srvConn, func(w io.Writer, id, tag uint8) {
+		switch id {
+		case 10:
+			callTag = tag
+			close(called)
+		case 6:
+			sendTag <- tag
+			writeFrame(w, 11, callTag)
+		}
+	})
+
+	c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: time.Second})
+	defer cliConn.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{})
+	}()
+	<-called
+
+	if err := c.Send(6, rpc.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if tag := <-sendTag; tag == callTag {
+		t.Errorf("Send used tag %d of an outstanding call", tag)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+type numMessage struct {
+	N uint16
+}
+
+func (m *numMessage) MarshalRPC(buf []byte) ([]byte, error) {
+	return append(buf, byte(m.N>>8), byte(m.N)), nil
+}
+
+func (m *numMessage) UnmarshalRPC(d *rpc.Decoder) error {
+	m.N = d.Uint16()
+	return d.Err()
+}
+
+func TestCancelledTagQuarantine(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const stale = 0xffff
+	cliConn, srvConn := net.Pipe()
+
+	// The server never answers the first request until 300
+	// more have been made, and answers any reuse of its tag with
+	// a stale response before the real one.
+	var firstTag uint8
+	var n int
+	fakeServerBody(t, srvConn, func(w io.Writer, id, tag uint8, body []byte) {
+		defer func() { n++ }()
+		if n == 0 {
+			firstTag = tag
+			return
+		}
+		if n == 300 {
+			writeFrame(w, id+1, firstTag, stale>>8, stale&0xff)
+		} else if n < 300 && tag == firstTag {
+			writeFrame(w, id+1, tag, stale>>8, stale&0xff)
+		}
+		writeFrame(w, append([]byte{id + 1, tag}, body...)...)
+	})
+
+	c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: time.Second})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var res numMessage
+	if err := c.Call(ctx, 10, &numMessage{0}, &res); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	for i := uint16(1); i < 600; i++ {
+		var res numMessage
+		if err := c.Call(context.Background(), 10, &numMessage{i}, &res); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if res.N != i {
+			t.Fatalf("call %d: got response %d", i, res.N)
+		}
+	}
+}
+
+func TestBadResponses(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte{11}},
+		{"unknown tag", []byte{11, 254}},
+		{"bad type", []byte{99, 0}},
+		{"truncated", []byte{0, 10, 11}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+
+			cliConn, srvConn := net.Pipe()
+			fakeServer(t, srvConn, func(w io.Writer, id, tag uint8) {
+				if test.name == "truncated" {
+					w.Write(test.frame)
+					srvConn.Close()
+					return
+				}
+				writeFrame(w, test.frame...)
+			})
+
+			c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: time.Second})
+			defer c.Close()
+
+			err := c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			t.Logf("%v (expected)", err)
+
+			// the client is unusable after a protocol error
+			if err := c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{}); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestCloseFailsPendingCalls(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	cliConn, srvConn := net.Pipe()
+	fakeServer(t, srvConn, func(w io.Writer, id, tag uint8) {})
+
+	c := rpc.NewClient(cliConn, rpc.Config{})
+
+	errc := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errc <- c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{})
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	for i := 0; i < 10; i++ {
+		if err := <-errc; err == nil {
+			t.Error("expected error")
+		}
+	}
+}
+
+type recordObserver struct {
+	mu    sync.Mutex
+	start []rpc.CallInfo
+	end   []rpc.CallInfo
+}
+
+func (o *recordObserver) CallStart(info rpc.CallInfo) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.start = append(o.start, info)
+}
+
+func (o *recordObserver) CallEnd(info rpc.CallInfo) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.end = append(o.end, info)
+}
+
+func TestObserver(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	fakeServerBody(t, srvConn, func(w io.Writer, id, tag uint8, body []byte) {
+		if id == 20 {
+			// error response
+			writeFrame(w, 1, tag, 0, 4, 'f', 'a', 'i', 'l')
+			return
+		}
+		writeFrame(w, append([]byte{id + 1, tag}, body...)...)
+	})
+
+	var o recordObserver
+	c := rpc.NewClient(cliConn, rpc.Config{IdleTimeout: time.Second, Observer: &o})
+	defer c.Close()
+
+	var res numMessage
+	if err := c.Call(context.Background(), 10, &numMessage{42}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(context.Background(), 20, rpc.Empty{}, rpc.Empty{}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if len(o.start) != 2 || len(o.end) != 2 {
+		t.Fatalf("got %d starts and %d ends, want 2", len(o.start), len(o.end))
+	}
+	if info := o.end[0]; info.FuncId != 10 || info.ReqSize != 6 || info.RespSize != 2 || info.Err != nil {
+		t.Errorf("bad info for successful call: %+v", info)
+	}
+	if info := o.end[1]; info.FuncId != 20 || info.Err == nil {
+		t.Errorf("bad info for failed call: %+v", info)
+	}
+	for i := range o.end {
+		if o.start[i].Tag != o.end[i].Tag || o.start[i].Start != o.end[i].Start {
+			t.Errorf("call %d: start and end do not match: %+v, %+v", i, o.start[i], o.end[i])
+		}
+		if o.end[i].Latency <= 0 {
+			t.Errorf("call %d: bad latency %v", i, o.end[i].Latency)
+		}
+	}
+}
+
+func TestCloseAfterHangup(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rpc.NewClient(conn, rpc.Config{})
+
+	// the hangup tears down the client, closing its connection
+	if err := c.Call(context.Background(), 10, rpc.Empty{}, rpc.Empty{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close after hangup: %v", err)
+	}
+}
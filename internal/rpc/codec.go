@@ -1,127 +1,246 @@
 package rpc
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"reflect"
+	"io"
+	"math"
 )
 
-func encode(msg interface{}, funcId, tag uint8) ([]byte, error) {
-	var buf bytes.Buffer
+// A Marshaler encodes the body of an rpc message.
+type Marshaler interface {
+	// MarshalRPC appends the encoded message body to buf
+	// and returns the extended buffer.
+	MarshalRPC(buf []byte) ([]byte, error)
+}
 
-	// reserved for final length
-	buf.Write([]byte{0, 0})
-
-	buf.WriteByte(funcId)
-	buf.WriteByte(tag)
-
-	structValue := reflect.ValueOf(msg)
-	var err error
-	for i := 0; i < structValue.NumField(); i++ {
-		f := structValue.Field(i)
-		switch v := f.Interface().(type) {
-		case uint8, uint16, uint32, uint64:
-			err = binary.Write(&buf, binary.BigEndian, v)
-		case string:
-			if structValue.Type().Field(i).Tag == "short" {
-				err = writeShortString(&buf, v)
-			} else {
-				err = writeString(&buf, v)
-			}
-		case []byte:
-			if i != structValue.NumField()-1 {
-				panic("unxepected []byte field")
-			}
-			buf.Write(v)
-		default:
-			if f.Kind() == reflect.Array && f.Type().Elem().Kind() == reflect.Uint8 {
-				for i := 0; i < f.Len(); i++ {
-					buf.WriteByte(f.Index(i).Interface().(uint8))
-				}
-			} else {
-				err = fmt.Errorf("cannot decode %T", v)
-			}
-		}
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	// final length minus two bytes reserved for length
-	// at the beginning of the buffer
-	length := uint16(buf.Len() - 2)
-
-	encoded := buf.Bytes()
-	binary.BigEndian.PutUint16(encoded, length)
-
-	return encoded, nil
-}
-
-func decode(dst interface{}, buf []byte) error {
-	r := bytes.NewReader(buf)
-	var err error
-	structValue := reflect.ValueOf(dst).Elem()
-	for i := 0; i < structValue.NumField(); i++ {
-		f := structValue.Field(i)
-		switch v := f.Interface().(type) {
-		// These cannot be compressed into a single
-		// case, or vv will not have the correct type.
-		// See https://golang.org/ref/spec#Type_switches.
-		case uint8:
-			err = binary.Read(r, binary.BigEndian, &v)
-			f.Set(reflect.ValueOf(v))
-		case uint16:
-			err = binary.Read(r, binary.BigEndian, &v)
-			f.Set(reflect.ValueOf(v))
-		case uint32:
-			err = binary.Read(r, binary.BigEndian, &v)
-			f.Set(reflect.ValueOf(v))
-		case uint64:
-			err = binary.Read(r, binary.BigEndian, &v)
-			f.Set(reflect.ValueOf(v))
-		case string:
-			var s string
-			if structValue.Type().Field(i).Tag == "short" {
-				s, err = readShortString(r)
-			} else {
-				s, err = readString(r)
-			}
-			f.SetString(s)
-		case []byte:
-			if i != structValue.NumField()-1 {
-				panic("unxepected []byte field")
-			}
-			length := r.Len()
-			n, _ := r.Read(v)
-
-			// kinda hacky: we communicate the read length back to
-			// the venti.Client using the slice length.
-			f.SetLen(n)
-
-			if length != n {
-				err = errors.New("short read")
-			}
-		default:
-			if f.Kind() == reflect.Array && f.Type().Elem().Kind() == reflect.Uint8 {
-				if f.Len() > r.Len() {
-					err = errors.New("short buffer")
-				}
-				for i := 0; i < f.Len(); i++ {
-					c, _ := r.ReadByte()
-					f.Index(i).Set(reflect.ValueOf(c))
-				}
-			} else {
-				err = fmt.Errorf("cannot decode %T", v)
-			}
-		}
-		if err != nil {
-			return fmt.Errorf("decode field index=%d type=%s: %v", i, f.Kind(), err)
-		}
-	}
-	if err, ok := dst.(*ServerError); ok {
-		return *err
+// An Unmarshaler decodes the body of an rpc message.
+type Unmarshaler interface {
+	// UnmarshalRPC decodes the message body from d. Variable
+	// length fields may be read directly into memory owned by
+	// the receiver, avoiding intermediate copies. The Decoder is
+	// reused for later messages, so it must not be retained.
+	UnmarshalRPC(d *Decoder) error
+}
+
+var errShortMessage = errors.New("short message")
+
+// A Decoder reads the fields of a single message body directly
+// from the connection. Decoding errors are sticky: after the first
+// error, all further reads return zero values, and Err reports
+// the error.
+type Decoder struct {
+	r *bufio.Reader
+	n int // bytes remaining in the message
+
+	err   error // decoding error
+	ioerr error // error from r; fatal to the connection
+
+	hdr [4 + 2]byte // header of the current message
+}
+
+// Len returns the number of unread bytes in the message body.
+func (d *Decoder) Len() int {
+	return d.n
+}
+
+// Err returns the first error encountered while decoding.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *Decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.n < 1 {
+		d.setErr(errShortMessage)
+		return 0
+	}
+	c, err := d.r.ReadByte()
+	if err != nil {
+		d.ioerr = err
+		d.setErr(err)
+		return 0
+	}
+	d.n--
+	return c
+}
+
+func (d *Decoder) Uint8() uint8 {
+	return d.readByte()
+}
+
+func (d *Decoder) Uint16() uint16 {
+	return uint16(d.readByte())<<8 | uint16(d.readByte())
+}
+
+func (d *Decoder) Uint32() uint32 {
+	return uint32(d.Uint16())<<16 | uint32(d.Uint16())
+}
+
+// Bytes reads exactly len(p) bytes into p.
+func (d *Decoder) Bytes(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if len(p) > d.n {
+		d.setErr(errShortMessage)
+		return
+	}
+	n, err := io.ReadFull(d.r, p)
+	d.n -= n
+	if err != nil {
+		d.ioerr = err
+		d.setErr(err)
+	}
+}
+
+// String reads a string with a 16-bit length prefix.
+func (d *Decoder) String() string {
+	return d.string(int(d.Uint16()))
+}
+
+// ShortString reads a string with an 8-bit length prefix.
+func (d *Decoder) ShortString() string {
+	return d.string(int(d.Uint8()))
+}
+
+func (d *Decoder) string(n int) string {
+	if d.err != nil || n == 0 {
+		return ""
+	}
+	buf := make([]byte, n)
+	d.Bytes(buf)
+	if d.err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+// discard skips the unread remainder of the message body.
+func (d *Decoder) discard() {
+	if d.ioerr != nil {
+		return
+	}
+	n, err := d.r.Discard(d.n)
+	d.n -= n
+	if err != nil {
+		d.ioerr = err
+	}
+}
+
+// AppendString appends s with a 16-bit length prefix.
+func AppendString(buf []byte, s string) ([]byte, error) {
+	if len(s) > math.MaxUint16 {
+		return nil, fmt.Errorf("string too long: %d bytes", len(s))
 	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...), nil
+}
+
+// AppendShortString appends s with an 8-bit length prefix.
+func AppendShortString(buf []byte, s string) ([]byte, error) {
+	if len(s) > math.MaxUint8 {
+		return nil, fmt.Errorf("short string too long: %d bytes", len(s))
+	}
+	buf = append(buf, uint8(len(s)))
+	return append(buf, s...), nil
+}
+
+// Empty is a message with no body.
+type Empty struct{}
+
+func (Empty) MarshalRPC(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (Empty) UnmarshalRPC(d *Decoder) error {
 	return nil
 }
+
+// encode appends a complete message to buf. If long is set, the
+// message has a 32-bit length, as in venti protocol version 04;
+// otherwise the length is 16 bits.
+func encode(buf []byte, msg Marshaler, funcId, tag uint8, long bool) ([]byte, error) {
+	start := len(buf)
+
+	// reserved for final length
+	n := lengthSize(long)
+	buf = append(buf, make([]byte, n)...)
+
+	buf = append(buf, funcId, tag)
+	buf, err := msg.MarshalRPC(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// final length minus the bytes reserved for length
+	// at the beginning of the message
+	length := len(buf) - start - n
+	if length > maxLength(long) {
+		return nil, fmt.Errorf("message too large: %d bytes", length)
+	}
+	if long {
+		binary.BigEndian.PutUint32(buf[start:], uint32(length))
+	} else {
+		binary.BigEndian.PutUint16(buf[start:], uint16(length))
+	}
+
+	return buf, nil
+}
+
+// readHeader reads the length, function id and tag of the next
+// message from d's reader, and resets d to decode its body. A
+// Decoder is reused for every message on a connection, so that
+// reading a message does not allocate.
+func (d *Decoder) readHeader(long bool) (funcId, tag uint8, err error) {
+	*d = Decoder{r: d.r}
+	n := lengthSize(long)
+	if _, err := io.ReadFull(d.r, d.hdr[:n]); err != nil {
+		return 0, 0, err
+	}
+	var length int
+	if long {
+		length = int(binary.BigEndian.Uint32(d.hdr[:]))
+	} else {
+		length = int(binary.BigEndian.Uint16(d.hdr[:]))
+	}
+	if length < 2 {
+		return 0, 0, fmt.Errorf("short message: length %d", length)
+	}
+	if length > maxLength(long) {
+		return 0, 0, fmt.Errorf("message too large: length %d", length)
+	}
+	if _, err := io.ReadFull(d.r, d.hdr[n:n+2]); err != nil {
+		return 0, 0, err
+	}
+	d.n = length - 2
+	return d.hdr[n], d.hdr[n+1], nil
+}
+
+func lengthSize(long bool) int {
+	if long {
+		return 4
+	}
+	return 2
+}
+
+// maxLongLength bounds the size of messages with 32-bit lengths,
+// which is far larger than any block.
+const maxLongLength = 1 << 30
+
+func maxLength(long bool) int {
+	if long {
+		return maxLongLength
+	}
+	return math.MaxUint16
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"bufio"
 	"bytes"
 	"testing"
 )
@@ -8,11 +9,41 @@ import (
 type TestMessage struct {
 	Int   uint16
 	Str   string
-	Short string "short"
+	Short string
 	Arr   [5]byte
 	Buf   []byte
 }
 
+func (m *TestMessage) MarshalRPC(buf []byte) ([]byte, error) {
+	buf = append(buf, byte(m.Int>>8), byte(m.Int))
+	var err error
+	if buf, err = AppendString(buf, m.Str); err != nil {
+		return nil, err
+	}
+	if buf, err = AppendShortString(buf, m.Short); err != nil {
+		return nil, err
+	}
+	buf = append(buf, m.Arr[:]...)
+	return append(buf, m.Buf...), nil
+}
+
+func (m *TestMessage) UnmarshalRPC(d *Decoder) error {
+	m.Int = d.Uint16()
+	m.Str = d.String()
+	m.Short = d.ShortString()
+	d.Bytes(m.Arr[:])
+	m.Buf = m.Buf[:d.Len()]
+	d.Bytes(m.Buf)
+	return d.Err()
+}
+
+func newTestDecoder(buf []byte) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(bytes.NewReader(buf)),
+		n: len(buf),
+	}
+}
+
 func TestCodec(t *testing.T) {
 	in := TestMessage{
 		Int:   0xabcd,
@@ -22,7 +53,7 @@ func TestCodec(t *testing.T) {
 		Buf:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
 	}
 
-	buf, err := encode(in, 99, 100)
+	buf, err := encode(nil, &in, 99, 100, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,10 +74,10 @@ func TestCodec(t *testing.T) {
 	}
 
 	out := TestMessage{
-		Buf: make([]byte, len(in.Buf)),
+		Buf: make([]byte, 100),
 	}
 	buf = buf[4:] // skip length (2) message type (1) and tag (1)
-	if err := decode(&out, buf); err != nil {
+	if err := out.UnmarshalRPC(newTestDecoder(buf)); err != nil {
 		t.Fatal(err)
 	}
 	if out.Int != in.Int {
@@ -55,6 +86,9 @@ func TestCodec(t *testing.T) {
 	if out.Str != in.Str {
 		t.Errorf("%v != %v", out.Str, in.Str)
 	}
+	if out.Short != in.Short {
+		t.Errorf("%v != %v", out.Short, in.Short)
+	}
 	if !bytes.Equal(out.Buf, in.Buf) {
 		t.Errorf("%v != %v", out.Buf, in.Buf)
 	}
@@ -64,9 +98,7 @@ func TestCodec(t *testing.T) {
 }
 
 func TestCodecEmpty(t *testing.T) {
-	var in struct{}
-
-	buf, err := encode(in, 99, 100)
+	buf, err := encode(nil, Empty{}, 99, 100, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,3 +111,95 @@ func TestCodecEmpty(t *testing.T) {
 		t.Fatalf("encode:\n\twant=%v,\n\t got=%v", want, buf)
 	}
 }
+
+func TestDecodeShort(t *testing.T) {
+	out := TestMessage{
+		Buf: make([]byte, 100),
+	}
+	err := out.UnmarshalRPC(newTestDecoder([]byte{0xab, 0xcd, 0, 6, 'f', 'o'}))
+	if err != errShortMessage {
+		t.Errorf("got %v, want %v", err, errShortMessage)
+	}
+}
+
+func TestStringEncoding(t *testing.T) {
+	buf, err := AppendString(nil, "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDecoder(buf)
+	s := d.String()
+	if err := d.Err(); err != nil {
+		t.Fatalf("failed to unpack string: %v", err)
+	}
+	if s != "foobar" {
+		t.Errorf("unpacked bad string: got %q, wanted %q", s, "foobar")
+	}
+
+	if _, err := AppendShortString(nil, string(make([]byte, 256))); err == nil {
+		t.Error("expected error for oversized short string")
+	}
+}
+
+var EncodedSink []byte
+
+func BenchmarkEncode(b *testing.B) {
+	msg := TestMessage{
+		Str: "foobar",
+		Buf: make([]byte, 8*1024),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		EncodedSink, err = encode(EncodedSink[:0], &msg, 99, 100, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// blockMessage is a message holding only a block,
+// such as a venti read response.
+type blockMessage struct {
+	Buf []byte
+}
+
+func (m *blockMessage) MarshalRPC(buf []byte) ([]byte, error) {
+	return append(buf, m.Buf...), nil
+}
+
+func (m *blockMessage) UnmarshalRPC(d *Decoder) error {
+	m.Buf = m.Buf[:d.Len()]
+	d.Bytes(m.Buf)
+	return d.Err()
+}
+
+// BenchmarkDecode decodes a block response straight into the
+// caller's buffer, as the client does, reusing one Decoder for
+// every message. It makes no allocations; reading and decoding the
+// same response with the reflection-based codec took 4 allocs/op.
+func BenchmarkDecode(b *testing.B) {
+	msg := blockMessage{Buf: make([]byte, 8*1024)}
+	encoded, err := encode(nil, &msg, 99, 100, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	br := bytes.NewReader(encoded)
+	r := bufio.NewReaderSize(br, 16*1024)
+	out := blockMessage{Buf: make([]byte, 8*1024)}
+	d := &Decoder{r: r}
+
+	b.SetBytes(int64(len(msg.Buf)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br.Reset(encoded)
+		r.Reset(br)
+		if _, _, err := d.readHeader(false); err != nil {
+			b.Fatal(err)
+		}
+		if err := out.UnmarshalRPC(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
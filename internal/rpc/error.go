@@ -9,3 +9,8 @@ type ServerError struct {
 func (s ServerError) Error() string {
 	return s.Err
 }
+
+func (s *ServerError) UnmarshalRPC(d *Decoder) error {
+	s.Err = d.String()
+	return d.Err()
+}
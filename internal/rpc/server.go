@@ -1,66 +1,78 @@
 package rpc
 
-type RpcFunc func(req, resp interface{}) error
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
 
-type Server struct {
-	obj interface{}
-}
+// ErrHangup may be returned by a Handler to close the connection
+// without responding, as venti servers do for goodbye messages.
+var ErrHangup = errors.New("hang up")
 
-type registration struct {
-	f         RpcFunc
-	req, resp interface{}
+// A Handler serves rpc requests.
+type Handler interface {
+	// ServeRPC decodes the body of a request from d and returns
+	// the response. A non-nil error is sent to the client as an
+	// error response, unless it is ErrHangup.
+	ServeRPC(funcId uint8, d *Decoder) (Marshaler, error)
 }
 
-func NewServer(obj interface{}) *Server {
-	return &Server{
-		obj: obj,
-	}
+type Server struct {
+	h Handler
 }
 
-// func (s *Server) ServeConn(conn net.Conn) error {
-// 	for {
-// 		//dprintf("server: ready to read a request")
-// 		var length uint16
-// 		if err := binary.Read(conn, binary.BigEndian, &length); err == io.EOF {
-// 			return nil
-// 		} else if err != nil {
-// 			return fmt.Errorf("read length: %v", err)
-// 		}
-
-// 		reqBuf := make([]byte, length)
-// 		if _, err := io.ReadFull(conn, reqBuf); err != nil {
-// 			return fmt.Errorf("read message: err")
-// 		}
-// 		id := reqBuf[0]
-// 		tag := reqBuf[1]
-// 		reqBuf = reqBuf[2:]
-
-// 		//dprintf("server: read a request tag=%d size=%d", tag, len(reqBuf))
+func NewServer(h Handler) *Server {
+	return &Server{h: h}
+}
 
-// 		s.mu.RLock()
-// 		reg, ok := s.funcs[id]
-// 		s.mu.RUnlock()
-// 		if !ok {
-// 			return fmt.Errorf("rpc: unregistered function: id=%d", id)
-// 		}
+// ServeConn reads requests from r and writes responses to w until
+// r is exhausted or the handler hangs up. Requests are handled
+// one at a time, in order. If long is set, messages have 32-bit
+// lengths, as in venti protocol version 04.
+func (s *Server) ServeConn(r *bufio.Reader, w io.Writer, long bool) error {
+	var buf []byte
+	d := &Decoder{r: r}
+	for {
+		funcId, tag, err := d.readHeader(long)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read request: %w", err)
+		}
 
-// 		if err := decode(reqBuf, &reg.req); err != nil {
-// 			return err
-// 		}
+		resp, err := s.h.ServeRPC(funcId, d)
+		d.discard()
+		if d.ioerr != nil {
+			return fmt.Errorf("read request: %w", d.ioerr)
+		}
+		if err == ErrHangup {
+			return nil
+		}
 
-// 		if err := reg.f(reg.req, &reg.resp); err != nil {
-// 			return err
-// 		}
+		respId := funcId + 1
+		if err != nil {
+			respId = rpcError
+			resp = &errorResponse{err.Error()}
+		}
+		buf, err = encode(buf[:0], resp, respId, tag, long)
+		if err != nil {
+			buf, err = encode(buf[:0], &errorResponse{err.Error()}, rpcError, tag, long)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("write response: %w", err)
+		}
+	}
+}
 
-// 		//log.Printf("server: encoding response type=%T tag=%d", resp, tag)
-// 		respBuf := encode(reg.resp, id+1, tag)
+type errorResponse struct {
+	Err string
+}
 
-// 		var buf bytes.Buffer
-// 		binary.Write(&buf, binary.BigEndian, uint16(len(respBuf)))
-// 		buf.Write(respBuf)
-// 		if _, err := buf.WriteTo(conn); err != nil {
-// 			return err
-// 		}
-// 		//dprintf("server: flushed response")
-// 	}
-// }
+func (m *errorResponse) MarshalRPC(buf []byte) ([]byte, error) {
+	return AppendString(buf, m.Err)
+}
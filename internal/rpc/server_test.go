@@ -1,31 +1,63 @@
 package rpc_test
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
 	"testing"
+
+	"sigint.ca/venti2/internal/rpc"
 )
 
+type incHandler struct{}
+
+func (incHandler) ServeRPC(funcId uint8, d *rpc.Decoder) (rpc.Marshaler, error) {
+	var m numMessage
+	if err := m.UnmarshalRPC(d); err != nil {
+		return nil, err
+	}
+	switch funcId {
+	case 10:
+		m.N++
+		return &m, nil
+	case 20:
+		return nil, rpc.ErrHangup
+	}
+	return nil, errors.New("unknown function")
+}
+
 func TestServeConn(t *testing.T) {
-	// cliConn, srvConn := net.Pipe()
+	for _, long := range []bool{false, true} {
+		cliConn, srvConn := net.Pipe()
 
-	// srv := rpc.NewServer()
-	// srv.Register(1, TestRPC{})
-	// go func() {
-	// 	if err := srv.ServeConn(srvConn); err != nil {
-	// 		t.Fatal(err)
-	// 	}
-	// }()
+		srv := rpc.NewServer(incHandler{})
+		errc := make(chan error, 1)
+		go func() {
+			errc <- srv.ServeConn(bufio.NewReader(srvConn), srvConn, long)
+			srvConn.Close()
+		}()
 
-	// cli := rpc.NewClient(cliConn)
+		cli := rpc.NewClient(cliConn, rpc.Config{LongMessages: long})
 
-	// req := TestReq{Foo: 1}
-	// var resp TestResp
-	// cli.Call(1, req, &resp)
-}
+		ctx := context.Background()
+		var res numMessage
+		if err := cli.Call(ctx, 10, &numMessage{41}, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.N != 42 {
+			t.Errorf("got %d, want 42", res.N)
+		}
 
-type TestRPC struct {
-}
+		err := cli.Call(ctx, 30, &numMessage{0}, &res)
+		if _, ok := err.(rpc.ServerError); !ok {
+			t.Errorf("got %v, want server error", err)
+		}
 
-func (t *TestRPC) Inc(arg int, ret *int) error {
-	*ret = arg + 1
-	return nil
+		cli.Send(20, &numMessage{0})
+		if err := <-errc; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+		cli.Close()
+	}
 }
@@ -1,16 +1,28 @@
 package rpc
 
+import "context"
+
 const ntag = 255
 
-func (c *Client) aqcuireTag() uint8 {
-	if c.tags == nil {
-		c.tags = make(chan uint8, ntag)
-		for i := uint8(0); i < ntag; i++ {
-			c.tags <- i
-		}
+func newTagPool() chan uint8 {
+	tags := make(chan uint8, ntag)
+	for i := uint8(0); i < ntag; i++ {
+		tags <- i
 	}
+	return tags
+}
 
-	return <-c.tags
+// acquireTag returns an unused tag, waiting until one is
+// available, ctx is done, or the client is closed.
+func (c *Client) acquireTag(ctx context.Context) (uint8, error) {
+	select {
+	case tag := <-c.tags:
+		return tag, nil
+	case <-c.closed:
+		return 0, c.closedErr()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 }
 
 func (c *Client) releaseTag(tag uint8) {
@@ -0,0 +1,261 @@
+package venti
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MemStore is an in-memory block store, useful for tests and
+// offline tools. Like a venti server, it records the type of each
+// block and only returns a block when read with a matching type;
+// the same data written with two types is stored as two blocks.
+// The zero value is an empty store. It is safe for concurrent use.
+type MemStore struct {
+	mu     sync.RWMutex
+	blocks map[memKey][]byte
+}
+
+// A memKey identifies a block by its score and on-disk type.
+type memKey struct {
+	score Score
+	typ   uint8
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		blocks: make(map[memKey][]byte),
+	}
+}
+
+// put stores a block. m.mu must be held.
+func (m *MemStore) put(k memKey, data []byte) {
+	if m.blocks == nil {
+		m.blocks = make(map[memKey][]byte)
+	}
+	m.blocks[k] = data
+}
+
+// ReadBlock reads a block as described by BlockReader. As with
+// Client, the zero score is always present as an empty block.
+func (m *MemStore) ReadBlock(ctx context.Context, s Score, t BlockType, buf []byte) (int, error) {
+	if s == ZeroScore() {
+		return 0, nil
+	}
+	if t.onDiskType() == CorruptType {
+		return 0, fmt.Errorf("read: %w: %d", ErrBadType, t)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	m.mu.RLock()
+	data, ok := m.blocks[memKey{s, t.onDiskType()}]
+	m.mu.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("read %v/%d: %w", s, t.onDiskType(), ErrNotFound)
+	}
+	if len(data) > len(buf) {
+		return 0, fmt.Errorf("read: block %v is too large: %d > %d", s, len(data), len(buf))
+	}
+	return copy(buf, data), nil
+}
+
+// WriteBlock writes a block as described by BlockWriter. The
+// contents of buf are copied. As with Client, empty blocks
+// are not stored, and have the zero score.
+func (m *MemStore) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
+	if len(buf) == 0 {
+		return ZeroScore(), nil
+	}
+	if len(buf) > MaxBigBlockSize {
+		return Score{}, fmt.Errorf("oversized block: %d > %d", len(buf), MaxBigBlockSize)
+	}
+	if t.onDiskType() == CorruptType {
+		return Score{}, fmt.Errorf("write: %w: %d", ErrBadType, t)
+	}
+	if err := ctx.Err(); err != nil {
+		return Score{}, fmt.Errorf("write: %w", err)
+	}
+
+	s := Fingerprint(buf)
+	k := memKey{s, t.onDiskType()}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blocks[k]; ok {
+		return s, nil
+	}
+	m.put(k, append([]byte(nil), buf...))
+	return s, nil
+}
+
+// Sync has nothing to do: every write to a MemStore is
+// immediately visible.
+func (m *MemStore) Sync(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Len returns the number of blocks in the store, counting
+// each type of the same data as a separate block.
+func (m *MemStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.blocks)
+}
+
+// Snapshot returns a copy of the store. Later writes to
+// either store are not visible in the other.
+func (m *MemStore) Snapshot() *MemStore {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c := &MemStore{
+		blocks: make(map[memKey][]byte, len(m.blocks)),
+	}
+	for k, data := range m.blocks {
+		// block data is never modified once stored
+		c.blocks[k] = data
+	}
+	return c
+}
+
+const memStoreMagic = "venti memstore 1\n"
+
+// WriteTo serializes the contents of the store to w, in a form
+// that can be read back by ReadFrom. Each block is written as its
+// score, on-disk type and 32-bit length, followed by its data.
+func (m *MemStore) WriteTo(w io.Writer) (int64, error) {
+	snap := m.Snapshot()
+	keys := make([]memKey, 0, len(snap.blocks))
+	for k := range snap.blocks {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := bytes.Compare(keys[i].score[:], keys[j].score[:]); c != 0 {
+			return c < 0
+		}
+		return keys[i].typ < keys[j].typ
+	})
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	bw.WriteString(memStoreMagic)
+	var hdr [ScoreSize + 1 + 4]byte
+	for _, k := range keys {
+		data := snap.blocks[k]
+		copy(hdr[:], k.score[:])
+		hdr[ScoreSize] = k.typ
+		binary.BigEndian.PutUint32(hdr[ScoreSize+1:], uint32(len(data)))
+		bw.Write(hdr[:])
+		bw.Write(data)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadFrom reads blocks serialized by WriteTo from r and adds them
+// to the store. The score of each block is verified.
+func (m *MemStore) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countReader{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(memStoreMagic))
+	if _, err := io.ReadFull(cr, magic); err != nil {
+		return cr.n, fmt.Errorf("read memstore header: %w", err)
+	}
+	if string(magic) != memStoreMagic {
+		return cr.n, errors.New("not a memstore file")
+	}
+
+	var hdr [ScoreSize + 1 + 4]byte
+	for {
+		if _, err := io.ReadFull(cr, hdr[:]); err == io.EOF {
+			return cr.n, nil
+		} else if err != nil {
+			return cr.n, fmt.Errorf("read block header: %w", err)
+		}
+		var s Score
+		copy(s[:], hdr[:])
+		typ := hdr[ScoreSize]
+		n := binary.BigEndian.Uint32(hdr[ScoreSize+1:])
+		if n == 0 || n > MaxBigBlockSize {
+			return cr.n, fmt.Errorf("block %v: bad size: %d", s, n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(cr, data); err != nil {
+			return cr.n, fmt.Errorf("block %v: %w", s, err)
+		}
+		if Fingerprint(data) != s {
+			return cr.n, fmt.Errorf("block %v: score mismatch", s)
+		}
+
+		m.mu.Lock()
+		m.put(memKey{s, typ}, data)
+		m.mu.Unlock()
+	}
+}
+
+// Save writes the contents of the store to the named file.
+// The file is replaced atomically.
+func (m *MemStore) Save(name string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := m.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// LoadMemStore returns a MemStore containing the blocks
+// in the named file, which was written by Save.
+func LoadMemStore(name string) (*MemStore, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := NewMemStore()
+	if _, err := m.ReadFrom(f); err != nil {
+		return nil, fmt.Errorf("load %s: %w", name, err)
+	}
+	return m, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,203 @@
+package venti
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+
+	block := []byte("the quick brown fox jumps over the lazy dog.")
+	s, err := m.WriteBlock(ctx, DataType, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != Fingerprint(block) {
+		t.Errorf("bad score: got %v, want %v", s, Fingerprint(block))
+	}
+	block[0] = 'T' // the store keeps its own copy
+
+	buf := make([]byte, 100)
+	n, err := m.ReadBlock(ctx, s, DataType, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "the quick brown fox jumps over the lazy dog."; string(buf[:n]) != want {
+		t.Errorf("read: got %q, want %q", buf[:n], want)
+	}
+
+	if _, err := m.ReadBlock(ctx, s, DirType, buf); err == nil {
+		t.Error("read with wrong type: expected error")
+	} else {
+		t.Logf("%v (expected)", err)
+	}
+	if _, err := m.ReadBlock(ctx, s, DataType, buf[:10]); err == nil {
+		t.Error("read into short buffer: expected error")
+	}
+	if _, err := m.ReadBlock(ctx, Fingerprint([]byte("missing")), DataType, buf); !errors.Is(err, ErrNotFound) {
+		t.Errorf("read missing block: got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := m.WriteBlock(ctx, MaxType, block); !errors.Is(err, ErrBadType) {
+		t.Errorf("write bad type: got %v, want %v", err, ErrBadType)
+	}
+
+	// pointer blocks of the same depth share an on-disk type
+	ptr := []byte("pointer block")
+	s, err = m.WriteBlock(ctx, DataType+1, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadBlock(ctx, s, DirType+1, buf); err != nil {
+		t.Errorf("read pointer block: %v", err)
+	}
+
+	// the zero score is always present, and empty blocks are not stored
+	if s, err := m.WriteBlock(ctx, DataType, nil); err != nil || s != ZeroScore() {
+		t.Errorf("write empty block: got %v, %v", s, err)
+	}
+	if n, err := m.ReadBlock(ctx, ZeroScore(), RootType, buf); err != nil || n != 0 {
+		t.Errorf("read zero score: got %d, %v", n, err)
+	}
+	if m.Len() != 2 {
+		t.Errorf("got %d blocks, want 2", m.Len())
+	}
+	if err := m.Sync(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for j := 0; j < 100; j++ {
+				block := fmt.Appendf(nil, "block %d", j)
+				s, err := m.WriteBlock(ctx, DataType, block)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := m.ReadBlock(ctx, s, DataType, buf); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if m.Len() != 100 {
+		t.Errorf("got %d blocks, want 100", m.Len())
+	}
+}
+
+func TestMemStoreSave(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+
+	var scores []Score
+	for i := 0; i < 10; i++ {
+		s, err := m.WriteBlock(ctx, BlockType(i%3)<<3, fmt.Appendf(nil, "block %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scores = append(scores, s)
+	}
+
+	snap := m.Snapshot()
+	if _, err := m.WriteBlock(ctx, DataType, []byte("after snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Len() != 10 {
+		t.Errorf("snapshot has %d blocks, want 10", snap.Len())
+	}
+
+	name := filepath.Join(t.TempDir(), "blocks")
+	if err := snap.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMemStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 10 {
+		t.Fatalf("loaded %d blocks, want 10", loaded.Len())
+	}
+	buf := make([]byte, 64)
+	for i, s := range scores {
+		n, err := loaded.ReadBlock(ctx, s, BlockType(i%3)<<3, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("block %d", i); string(buf[:n]) != want {
+			t.Errorf("got %q, want %q", buf[:n], want)
+		}
+	}
+
+	// corrupt data is rejected
+	var b bytes.Buffer
+	if _, err := snap.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	data[len(data)-1] ^= 0xff
+	if _, err := NewMemStore().ReadFrom(bytes.NewReader(data)); err == nil {
+		t.Error("expected error for corrupt block")
+	} else {
+		t.Logf("%v (expected)", err)
+	}
+}
+
+func TestMemStoreTypes(t *testing.T) {
+	ctx := context.Background()
+	var m MemStore // the zero value is usable
+
+	// the same data stored with two types is two blocks
+	block := []byte("data or directory")
+	for _, bt := range []BlockType{DataType, DirType} {
+		if _, err := m.WriteBlock(ctx, bt, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.Len() != 2 {
+		t.Errorf("got %d blocks, want 2", m.Len())
+	}
+
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	var loaded MemStore
+	if _, err := loaded.ReadFrom(&b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	for _, bt := range []BlockType{DataType, DirType} {
+		for _, store := range []*MemStore{&m, &loaded} {
+			n, err := store.ReadBlock(ctx, Fingerprint(block), bt, buf)
+			if err != nil {
+				t.Errorf("read %v: %v", bt, err)
+			} else if !bytes.Equal(buf[:n], block) {
+				t.Errorf("read %v: got %q, want %q", bt, buf[:n], block)
+			}
+		}
+	}
+
+	var empty MemStore
+	if _, err := empty.ReadBlock(ctx, Fingerprint(block), DataType, buf); !errors.Is(err, ErrNotFound) {
+		t.Errorf("read from empty store: got %v, want %v", err, ErrNotFound)
+	}
+}
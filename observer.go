@@ -0,0 +1,183 @@
+package venti
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"sigint.ca/venti2/internal/rpc"
+)
+
+// CallInfo describes a venti request for an Observer.
+type CallInfo struct {
+	FuncId uint8 // the venti message type of the request
+	Tag    uint8
+
+	// ReqSize is the size of the encoded request, including
+	// the message header.
+	ReqSize int
+
+	// RespSize is the size of the response body. It is
+	// only set at the end of a successful request.
+	RespSize int
+
+	Start   time.Time
+	Latency time.Duration // set at the end of the request
+	Err     error         // set at the end of the request
+}
+
+// Op returns the name of the request type, such as "read".
+func (i CallInfo) Op() string {
+	switch i.FuncId {
+	case rpcPing:
+		return "ping"
+	case rpcHello:
+		return "hello"
+	case rpcGoodbye:
+		return "goodbye"
+	case rpcAuth0:
+		return "auth0"
+	case rpcAuth1:
+		return "auth1"
+	case rpcRead:
+		return "read"
+	case rpcWrite:
+		return "write"
+	case rpcSync:
+		return "sync"
+	default:
+		return fmt.Sprintf("func%d", i.FuncId)
+	}
+}
+
+// An Observer is notified at the start and end of each request made
+// by a Client. Its methods are called synchronously, possibly from
+// many goroutines at once, and should return quickly.
+type Observer interface {
+	CallStart(info CallInfo)
+	CallEnd(info CallInfo)
+}
+
+// WithObserver sets an Observer to be notified of each request
+// made by the client, including the hello message sent by Dial.
+func WithObserver(o Observer) DialOption {
+	return func(c *dialConfig) {
+		c.observer = o
+	}
+}
+
+// rpcObserver adapts an Observer to the rpc package.
+type rpcObserver struct {
+	o Observer
+}
+
+func (r rpcObserver) CallStart(info rpc.CallInfo) {
+	r.o.CallStart(CallInfo(info))
+}
+
+func (r rpcObserver) CallEnd(info rpc.CallInfo) {
+	r.o.CallEnd(CallInfo(info))
+}
+
+// Counters is an Observer that accumulates per-request-type
+// statistics. It is safe for concurrent use.
+type Counters struct {
+	mu  sync.Mutex
+	ops map[uint8]*OpCounters
+}
+
+// OpCounters holds the statistics for one type of request.
+type OpCounters struct {
+	Calls     int64
+	Errors    int64
+	InFlight  int64
+	BytesSent int64
+	BytesRecv int64
+
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+func (c *Counters) op(id uint8) *OpCounters {
+	if c.ops == nil {
+		c.ops = make(map[uint8]*OpCounters)
+	}
+	oc := c.ops[id]
+	if oc == nil {
+		oc = new(OpCounters)
+		c.ops[id] = oc
+	}
+	return oc
+}
+
+func (c *Counters) CallStart(info CallInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oc := c.op(info.FuncId)
+	oc.InFlight++
+	oc.BytesSent += int64(info.ReqSize)
+}
+
+func (c *Counters) CallEnd(info CallInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oc := c.op(info.FuncId)
+	oc.InFlight--
+	oc.Calls++
+	if info.Err != nil {
+		oc.Errors++
+	}
+	oc.BytesRecv += int64(info.RespSize)
+	oc.TotalLatency += info.Latency
+	if info.Latency > oc.MaxLatency {
+		oc.MaxLatency = info.Latency
+	}
+}
+
+// Snapshot returns a copy of the counters, keyed by request type.
+func (c *Counters) Snapshot() map[string]OpCounters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]OpCounters, len(c.ops))
+	for id, oc := range c.ops {
+		m[CallInfo{FuncId: id}.Op()] = *oc
+	}
+	return m
+}
+
+// WriteTo writes a table of the counters to w.
+func (c *Counters) WriteTo(w io.Writer) (int64, error) {
+	snap := c.Snapshot()
+	ops := make([]string, 0, len(snap))
+	for op := range snap {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var buf strings.Builder
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcalls\terrors\tsent\trecv\tavg\tmax\t")
+	for _, op := range ops {
+		oc := snap[op]
+		var avg time.Duration
+		if oc.Calls > 0 {
+			avg = oc.TotalLatency / time.Duration(oc.Calls)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%v\t%v\t\n", op, oc.Calls, oc.Errors,
+			oc.BytesSent, oc.BytesRecv, avg.Round(time.Microsecond), oc.MaxLatency.Round(time.Microsecond))
+	}
+	tw.Flush()
+
+	n, err := io.WriteString(w, buf.String())
+	return int64(n), err
+}
+
+func (c *Counters) String() string {
+	var buf strings.Builder
+	c.WriteTo(&buf)
+	return buf.String()
+}
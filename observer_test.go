@@ -0,0 +1,44 @@
+package venti
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	var c Counters
+
+	for i := 0; i < 3; i++ {
+		info := CallInfo{FuncId: rpcRead, ReqSize: 30}
+		c.CallStart(info)
+		info.RespSize = 8192
+		info.Latency = time.Duration(i+1) * time.Millisecond
+		c.CallEnd(info)
+	}
+	info := CallInfo{FuncId: rpcWrite, ReqSize: 100}
+	c.CallStart(info)
+	info.Err = errors.New("failed")
+	c.CallEnd(info)
+
+	snap := c.Snapshot()
+	read := snap["read"]
+	if read.Calls != 3 || read.BytesSent != 90 || read.BytesRecv != 3*8192 {
+		t.Errorf("bad read counters: %+v", read)
+	}
+	if read.MaxLatency != 3*time.Millisecond || read.TotalLatency != 6*time.Millisecond {
+		t.Errorf("bad read latency: %+v", read)
+	}
+	if write := snap["write"]; write.Calls != 1 || write.Errors != 1 || write.InFlight != 0 {
+		t.Errorf("bad write counters: %+v", write)
+	}
+
+	s := c.String()
+	t.Logf("\n%s", s)
+	for _, want := range []string{"read", "write", "24576", "2ms"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("output does not contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package venti
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// pointerCacheSize is the number of pointer blocks cached by a
+// ReaderAt. With 8k blocks, this covers several gigabytes of data.
+const pointerCacheSize = 1024
+
+// A ReaderAt provides random access to the data of the source
+// described by an Entry. Pointer blocks are cached, so once the
+// tree is warm each read costs one data block fetch per block it
+// spans. A ReaderAt is safe for concurrent use.
+type ReaderAt struct {
+	br BlockReader
+	e  Entry
+
+	bufs sync.Pool // data block buffers
+
+	mu    sync.Mutex
+	cache map[Score]*pointerBlock
+	lru   list.List // of *pointerBlock, most recently used first
+}
+
+type pointerBlock struct {
+	score Score
+	elem  *list.Element
+	ready chan struct{} // closed once buf and err are set
+	buf   []byte
+	err   error
+
+	cancelled bool // err is due to the fetcher's ctx
+}
+
+// NewReaderAt returns a ReaderAt reading the source described by e.
+func NewReaderAt(br BlockReader, e Entry) *ReaderAt {
+	r := &ReaderAt{
+		br:    br,
+		e:     e,
+		cache: make(map[Score]*pointerBlock),
+	}
+	r.bufs.New = func() interface{} {
+		return make([]byte, e.Dsize)
+	}
+	return r
+}
+
+// Size returns the size of the source.
+func (r *ReaderAt) Size() int64 {
+	return r.e.Size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is like ReadAt, but the block reads use ctx.
+func (r *ReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("read: negative offset")
+	}
+	if off >= r.e.Size {
+		return 0, io.EOF
+	}
+
+	var n int
+	if max := r.e.Size - off; int64(len(p)) > max {
+		p = p[:max]
+	}
+	dsize := int64(r.e.Dsize)
+	for len(p) > 0 {
+		b, boff := off/dsize, int(off%dsize)
+		m, err := r.readBlock(ctx, b, boff, p)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		off += int64(m)
+	}
+	if off == r.e.Size {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock copies data from data block b, starting
+// at offset boff, to p. Blocks are zero-extended.
+func (r *ReaderAt) readBlock(ctx context.Context, b int64, boff int, p []byte) (int, error) {
+	score, err := r.nodeScore(ctx, 0, b)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := r.bufs.Get().([]byte)
+	defer r.bufs.Put(buf)
+	n, err := r.br.ReadBlock(ctx, score, r.e.BaseType(), buf)
+	if err != nil {
+		return 0, err
+	}
+	memset(buf[n:], 0)
+	return copy(p, buf[boff:]), nil
+}
+
+// nodeScore returns the score of block b at the given level of the
+// tree, where level 0 is the data blocks, descending the pointer
+// blocks from the root of the tree.
+func (r *ReaderAt) nodeScore(ctx context.Context, level int, b int64) (Score, error) {
+	depth := r.e.Depth()
+	if level > depth {
+		return Score{}, fmt.Errorf("level %d is above the root of a depth %d tree", level, depth)
+	}
+	score := r.e.Score
+	for i, idx := range blockPath(b, depth-level, r.e.Psize/ScoreSize) {
+		if score == ZeroScore() {
+			// a hole: everything beneath it is zero
+			return score, nil
+		}
+		buf, err := r.pointerBlock(ctx, score, r.e.Type-BlockType(i))
+		if err != nil {
+			return Score{}, err
+		}
+		if (idx+1)*ScoreSize > int64(len(buf)) {
+			// truncated trailing zero scores
+			return ZeroScore(), nil
+		}
+		score = unpackScore(buf, int(idx))
+	}
+	return score, nil
+}
+
+// pointerBlock returns the contents of a pointer block, reading it
+// from br if it is not cached. Concurrent reads of the same block
+// share one fetch, made with the ctx of the first; if that ctx is
+// done before the fetch completes, the others fetch it again.
+func (r *ReaderAt) pointerBlock(ctx context.Context, score Score, t BlockType) ([]byte, error) {
+	for {
+		r.mu.Lock()
+		pb, ok := r.cache[score]
+		if !ok {
+			break // with r.mu held
+		}
+		r.lru.MoveToFront(pb.elem)
+		r.mu.Unlock()
+		select {
+		case <-pb.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pb.cancelled {
+			// the fetcher's ctx is done, not ours
+			continue
+		}
+		if pb.err != nil {
+			return nil, pb.err
+		}
+		return pb.buf, nil
+	}
+
+	pb := &pointerBlock{
+		score: score,
+		ready: make(chan struct{}),
+	}
+	pb.elem = r.lru.PushFront(pb)
+	r.cache[score] = pb
+	for r.lru.Len() > pointerCacheSize {
+		old := r.lru.Remove(r.lru.Back()).(*pointerBlock)
+		delete(r.cache, old.score)
+	}
+	r.mu.Unlock()
+
+	buf := make([]byte, r.e.Psize)
+	n, err := r.br.ReadBlock(ctx, score, t, buf)
+	if err != nil {
+		// don't cache failures
+		r.mu.Lock()
+		if r.cache[score] == pb {
+			r.lru.Remove(pb.elem)
+			delete(r.cache, score)
+		}
+		r.mu.Unlock()
+		pb.err = err
+		pb.cancelled = ctx.Err() != nil
+	} else {
+		pb.buf = buf[:n]
+	}
+	close(pb.ready)
+	return pb.buf, pb.err
+}
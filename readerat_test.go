@@ -0,0 +1,137 @@
+package venti
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReaderAt(t *testing.T) {
+	m := NewMemStore()
+
+	data := testData(5000)
+	// a run of zeros spanning whole blocks
+	for i := 1000; i < 1100; i++ {
+		data[i] = 0
+	}
+	e := writeSource(t, m, data, 4*ScoreSize, 20)
+
+	cr := &countingReader{BlockReader: m}
+	r := NewReaderAt(cr, e)
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("got size %d, want %d", r.Size(), len(data))
+	}
+
+	// the whole source, in one read
+	buf := make([]byte, len(data)+10)
+	n, err := r.ReadAt(buf, 0)
+	if n != len(data) || err != io.EOF {
+		t.Fatalf("read all: got %d, %v", n, err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatal("read all: data differs")
+	}
+
+	// now the pointer blocks are cached
+	before := cr.count()
+	if _, err := r.ReadAt(buf[:5], 3210); err != nil {
+		t.Fatal(err)
+	}
+	if n := cr.count() - before; n != 1 {
+		t.Errorf("cached read cost %d block reads, want 1", n)
+	}
+
+	if _, err := r.ReadAt(buf, int64(len(data))); err != io.EOF {
+		t.Errorf("read at end: got %v, want EOF", err)
+	}
+	if _, err := r.ReadAt(buf, -1); err == nil {
+		t.Error("read at negative offset: expected error")
+	}
+
+	// random reads in parallel
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			buf := make([]byte, 100)
+			for i := 0; i < 200; i++ {
+				off := rnd.Int63n(int64(len(data)))
+				p := buf[:rnd.Intn(len(buf))+1]
+				n, err := r.ReadAt(p, off)
+				if err != nil && err != io.EOF {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+					t.Errorf("read %d bytes at %d: data differs", len(p), off)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+}
+
+// stallingReader blocks its first read until the
+// reader's ctx is done, and passes on the others.
+type stallingReader struct {
+	BlockReader
+	once    sync.Once
+	stalled chan struct{} // closed once the first read is blocked
+}
+
+func (r *stallingReader) ReadBlock(ctx context.Context, s Score, t BlockType, buf []byte) (int, error) {
+	first := false
+	r.once.Do(func() { first = true })
+	if first {
+		close(r.stalled)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return r.BlockReader.ReadBlock(ctx, s, t, buf)
+}
+
+func TestReaderAtSharedFetchCancel(t *testing.T) {
+	m := NewMemStore()
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	e := writeSource(t, m, data, 3*ScoreSize, 20)
+
+	sr := &stallingReader{BlockReader: m, stalled: make(chan struct{})}
+	r := NewReaderAt(sr, e)
+
+	// the first reader fetches the root pointer block, and
+	// is cancelled while the second waits on its fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := r.ReadAtContext(ctx, make([]byte, 10), 0)
+		errc <- err
+	}()
+	<-sr.stalled
+
+	done := make(chan error)
+	buf := make([]byte, 10)
+	go func() {
+		_, err := r.ReadAtContext(context.Background(), buf, 500)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let it wait on the fetch
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled reader: got %v, want %v", err, context.Canceled)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("waiting reader: %v", err)
+	} else if !bytes.Equal(buf, data[500:510]) {
+		t.Error("waiting reader: data differs")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // TODO: when should scores be pointers vs values?
@@ -31,7 +32,19 @@ func ReadScore(s *Score, r io.Reader) error {
 	return nil
 }
 
+// scorePrefixes are the prefixes which may precede a score in
+// hexadecimal, such as the "vac:" printed by vac.
+var scorePrefixes = []string{"vac:", "venti:"}
+
+// ParseScore parses a score in hexadecimal, optionally
+// preceded by a "vac:" or "venti:" prefix.
 func ParseScore(s string) (Score, error) {
+	for _, prefix := range scorePrefixes {
+		if strings.HasPrefix(s, prefix) {
+			s = s[len(prefix):]
+			break
+		}
+	}
 	if len(s) != ScoreSize*2 {
 		return Score{}, fmt.Errorf("bad score size: %d", len(s))
 	}
@@ -62,8 +75,64 @@ func Fingerprint(data []byte) Score {
 	return sha1.Sum(data)
 }
 
-func (s *Score) String() string {
-	return fmt.Sprintf("%x", [ScoreSize]byte(*s))
+// IsZero reports whether s is the score of the
+// empty block, ZeroScore.
+func (s Score) IsZero() bool {
+	return s == ZeroScore()
+}
+
+// String returns s in hexadecimal.
+func (s Score) String() string {
+	return fmt.Sprintf("%x", [ScoreSize]byte(s))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that scores
+// are encoded in hexadecimal, including as JSON strings.
+func (s Score) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler,
+// accepting the forms parsed by ParseScore.
+func (s *Score) UnmarshalText(text []byte) error {
+	score, err := ParseScore(string(text))
+	if err != nil {
+		return err
+	}
+	*s = score
+	return nil
+}
+
+// Set parses a score with ParseScore and stores it in s,
+// so that a *Score can be used as a flag.Value.
+func (s *Score) Set(text string) error {
+	return s.UnmarshalText([]byte(text))
+}
+
+// A ScoreFlag is a flag.Value for an optional score, which
+// records whether the flag was set, and so distinguishes a
+// missing score from any valid one.
+type ScoreFlag struct {
+	Score Score
+	IsSet bool
+}
+
+// Set implements flag.Value.
+func (f *ScoreFlag) Set(text string) error {
+	if err := f.Score.Set(text); err != nil {
+		return err
+	}
+	f.IsSet = true
+	return nil
+}
+
+// String implements flag.Value. It is empty if
+// the flag was not set.
+func (f *ScoreFlag) String() string {
+	if f == nil || !f.IsSet {
+		return ""
+	}
+	return f.Score.String()
 }
 
 func (s *Score) Bytes() []byte {
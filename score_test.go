@@ -0,0 +1,113 @@
+package venti
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestParseScore(t *testing.T) {
+	want := Fingerprint([]byte("hello"))
+	hex := fmt.Sprintf("%x", want[:])
+	for _, s := range []string{hex, "vac:" + hex, "venti:" + hex} {
+		got, err := ParseScore(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+		} else if got != want {
+			t.Errorf("%q: got %v, want %v", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "vac:", "foo:" + hex, "vac:vac:" + hex, hex[1:] + "g"} {
+		if _, err := ParseScore(s); err == nil {
+			t.Errorf("%q: parsed bad score", s)
+		} else {
+			t.Logf("%v (expected)", err)
+		}
+	}
+}
+
+func TestScoreFormat(t *testing.T) {
+	s := ZeroScore()
+	const want = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	for _, got := range []string{s.String(), fmt.Sprintf("%v", s), fmt.Sprintf("%v", &s)} {
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if !s.IsZero() {
+		t.Errorf("%v is not zero", s)
+	}
+	if (Score{}).IsZero() || Fingerprint([]byte("x")).IsZero() {
+		t.Errorf("non-empty block score is zero")
+	}
+}
+
+func TestScoreJSON(t *testing.T) {
+	type doc struct {
+		Root  Score
+		Prev  *Score
+		Files []Score
+	}
+	prev := Fingerprint([]byte("prev"))
+	in := doc{
+		Root:  Fingerprint([]byte("root")),
+		Prev:  &prev,
+		Files: []Score{ZeroScore(), Fingerprint([]byte("file"))},
+	}
+	buf, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`{"Root":"%v","Prev":"%v","Files":["%v","%v"]}`, in.Root, prev, in.Files[0], in.Files[1])
+	if string(buf) != want {
+		t.Errorf("got %s, want %s", buf, want)
+	}
+
+	var out doc
+	if err := json.Unmarshal(buf, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Root != in.Root || *out.Prev != prev || len(out.Files) != 2 ||
+		out.Files[0] != in.Files[0] || out.Files[1] != in.Files[1] {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Root":"vac:`+in.Root.String()+`"}`), &out); err != nil {
+		t.Error(err)
+	} else if out.Root != in.Root {
+		t.Errorf("got %v, want %v", out.Root, in.Root)
+	}
+	if err := json.Unmarshal([]byte(`{"Root":"bad"}`), &out); err == nil {
+		t.Error("unmarshaled bad score")
+	}
+}
+
+func TestScoreFlag(t *testing.T) {
+	want := Fingerprint([]byte("flag"))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var s Score
+	var opt, unset ScoreFlag
+	fs.Var(&s, "s", "a score")
+	fs.Var(&opt, "opt", "an optional score")
+	fs.Var(&unset, "unset", "an optional score")
+	if err := fs.Parse([]string{"-s", want.String(), "-opt", "vac:" + want.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Errorf("-s: got %v, want %v", s, want)
+	}
+	if !opt.IsSet || opt.Score != want {
+		t.Errorf("-opt: got %v (set: %v), want %v", opt.Score, opt.IsSet, want)
+	}
+	if unset.IsSet || unset.String() != "" {
+		t.Errorf("-unset: got %q (set: %v), want unset", unset.String(), unset.IsSet)
+	}
+
+	if err := fs.Parse([]string{"-opt", "bad"}); err == nil {
+		t.Error("parsed bad score")
+	}
+}
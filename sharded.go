@@ -0,0 +1,231 @@
+package venti
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultVirtualNodes is the default number of points each shard
+// of a ShardedStore occupies on the hash ring.
+const DefaultVirtualNodes = 64
+
+// A ShardedStore spreads blocks across several BlockStores using
+// consistent hashing on the score prefix, so that adding a shard
+// moves only a proportional share of the blocks.
+//
+// A shard may be added with a migration period, during which a
+// block not found in its new shard is read from the shard that
+// owned it before, and copied to the new shard. This allows blocks
+// to move lazily while the new shard is being filled.
+//
+// A ShardedStore is safe for concurrent use.
+type ShardedStore struct {
+	vnodes int
+
+	mu         sync.RWMutex
+	ring       *hashRing
+	migrations []migration // newest first
+}
+
+type migration struct {
+	ring  *hashRing // the ring before the shard was added
+	until time.Time
+}
+
+// NewShardedStore returns a ShardedStore with no shards, which
+// places each shard at vnodes points on the hash ring. If vnodes
+// <= 0, DefaultVirtualNodes is used.
+func NewShardedStore(vnodes int) *ShardedStore {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &ShardedStore{
+		vnodes: vnodes,
+		ring:   new(hashRing),
+	}
+}
+
+// AddShard adds a shard with the given name, which must be unique
+// and determines the shard's place on the hash ring. If migrate is
+// positive, reads fall back to the previous owner of each block for
+// that long.
+func (s *ShardedStore) AddShard(name string, bs BlockStore, migrate time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sh := range s.ring.shards {
+		if sh.name == name {
+			return fmt.Errorf("shard %q already exists", name)
+		}
+	}
+
+	prev := s.ring
+	s.ring = prev.add(&shard{name: name, store: bs}, s.vnodes)
+	if migrate > 0 && len(prev.shards) > 0 {
+		m := migration{ring: prev, until: time.Now().Add(migrate)}
+		s.migrations = append([]migration{m}, s.migrations...)
+	}
+	return nil
+}
+
+// EndMigration ends any migration periods early.
+func (s *ShardedStore) EndMigration() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.migrations = nil
+}
+
+// Migrating reports whether a migration period is in progress.
+func (s *ShardedStore) Migrating() bool {
+	_, migrations := s.state()
+	return len(migrations) > 0
+}
+
+// state returns the current ring and any active migrations.
+func (s *ShardedStore) state() (*hashRing, []migration) {
+	now := time.Now()
+
+	s.mu.RLock()
+	ring, migrations := s.ring, s.migrations
+	s.mu.RUnlock()
+	expired := false
+	for _, m := range migrations {
+		if !now.Before(m.until) {
+			expired = true
+		}
+	}
+	if !expired {
+		return ring, migrations
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := s.migrations[:0:0]
+	for _, m := range s.migrations {
+		if now.Before(m.until) {
+			active = append(active, m)
+		}
+	}
+	s.migrations = active
+	return s.ring, s.migrations
+}
+
+func (s *ShardedStore) ReadBlock(ctx context.Context, score Score, t BlockType, buf []byte) (int, error) {
+	ring, migrations := s.state()
+	owner := ring.lookup(score)
+	if owner == nil {
+		return 0, errors.New("read: no shards")
+	}
+	n, err := owner.store.ReadBlock(ctx, score, t, buf)
+	if err == nil || !errors.Is(err, ErrNotFound) || len(migrations) == 0 {
+		return n, err
+	}
+
+	tried := map[*shard]bool{owner: true}
+	for _, m := range migrations {
+		prev := m.ring.lookup(score)
+		if tried[prev] {
+			continue
+		}
+		tried[prev] = true
+		n, perr := prev.store.ReadBlock(ctx, score, t, buf)
+		if errors.Is(perr, ErrNotFound) {
+			continue
+		} else if perr != nil {
+			return 0, fmt.Errorf("shard %s: %w", prev.name, perr)
+		}
+		if _, werr := owner.store.WriteBlock(ctx, t, buf[:n]); werr != nil {
+			return 0, fmt.Errorf("migrate %v to shard %s: %w", score, owner.name, werr)
+		}
+		return n, nil
+	}
+	return 0, err
+}
+
+func (s *ShardedStore) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
+	ring, _ := s.state()
+	owner := ring.lookup(Fingerprint(buf))
+	if owner == nil {
+		return Score{}, errors.New("write: no shards")
+	}
+	return owner.store.WriteBlock(ctx, t, buf)
+}
+
+// Sync syncs all shards concurrently.
+func (s *ShardedStore) Sync(ctx context.Context) error {
+	ring, _ := s.state()
+
+	errs := make([]error, len(ring.shards))
+	var wg sync.WaitGroup
+	for i, sh := range ring.shards {
+		wg.Add(1)
+		go func(i int, sh *shard) {
+			defer wg.Done()
+			if err := sh.store.Sync(ctx); err != nil {
+				errs[i] = fmt.Errorf("shard %s: %w", sh.name, err)
+			}
+		}(i, sh)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+type shard struct {
+	name  string
+	store BlockStore
+}
+
+// A hashRing maps scores to shards. It is immutable
+// once built, so it may be shared without locking.
+type hashRing struct {
+	shards []*shard
+	points []ringPoint // sorted by pos
+}
+
+type ringPoint struct {
+	pos   uint64
+	shard *shard
+}
+
+// add returns a new ring with sh added at n points.
+func (r *hashRing) add(sh *shard, n int) *hashRing {
+	nr := &hashRing{
+		shards: append(r.shards[:len(r.shards):len(r.shards)], sh),
+		points: make([]ringPoint, len(r.points), len(r.points)+n),
+	}
+	copy(nr.points, r.points)
+	for i := 0; i < n; i++ {
+		h := sha1.Sum([]byte(sh.name + "#" + strconv.Itoa(i)))
+		nr.points = append(nr.points, ringPoint{
+			pos:   binary.BigEndian.Uint64(h[:]),
+			shard: sh,
+		})
+	}
+	sort.Slice(nr.points, func(i, j int) bool {
+		return nr.points[i].pos < nr.points[j].pos
+	})
+	return nr
+}
+
+// lookup returns the shard owning score, the first at or after
+// the score's prefix on the ring, or nil if the ring is empty.
+func (r *hashRing) lookup(score Score) *shard {
+	if len(r.points) == 0 {
+		return nil
+	}
+	pos := binary.BigEndian.Uint64(score[:])
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].pos >= pos
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
@@ -0,0 +1,154 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestBlocks(t *testing.T, bw BlockWriter, n int) []Score {
+	t.Helper()
+	var scores []Score
+	for i := 0; i < n; i++ {
+		s, err := bw.WriteBlock(context.Background(), DataType, fmt.Appendf(nil, "block %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scores = append(scores, s)
+	}
+	return scores
+}
+
+// countReadable returns the number of scores that can be read from br.
+func countReadable(t *testing.T, br BlockReader, scores []Score) int {
+	t.Helper()
+	buf := make([]byte, 64)
+	var n int
+	for _, s := range scores {
+		_, err := br.ReadBlock(context.Background(), s, DataType, buf)
+		if err == nil {
+			n++
+		} else if !errors.Is(err, ErrNotFound) {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func TestShardedStore(t *testing.T) {
+	s := NewShardedStore(0)
+	if _, err := s.WriteBlock(context.Background(), DataType, []byte("foo")); err == nil {
+		t.Error("write with no shards: expected error")
+	}
+
+	shards := []*MemStore{NewMemStore(), NewMemStore(), NewMemStore()}
+	for i, m := range shards {
+		if err := s.AddShard(fmt.Sprintf("shard%d", i), m, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddShard("shard0", NewMemStore(), 0); err == nil {
+		t.Error("duplicate shard: expected error")
+	}
+
+	const n = 3000
+	scores := writeTestBlocks(t, s, n)
+	for i, m := range shards {
+		t.Logf("shard%d: %d blocks", i, m.Len())
+		if m.Len() < n/6 {
+			t.Errorf("shard%d has only %d of %d blocks", i, m.Len(), n)
+		}
+	}
+	if got := countReadable(t, s, scores); got != n {
+		t.Errorf("read %d of %d blocks", got, n)
+	}
+
+	// Without a migration period, blocks that move to a new
+	// shard are no longer found, but no others move.
+	snap := NewShardedStore(0)
+	for i, m := range shards {
+		snap.AddShard(fmt.Sprintf("shard%d", i), m.Snapshot(), 0)
+	}
+	if err := snap.AddShard("shard3", NewMemStore(), 0); err != nil {
+		t.Fatal(err)
+	}
+	moved := n - countReadable(t, snap, scores)
+	t.Logf("%d of %d blocks moved", moved, n)
+	if moved == 0 || moved > n/2 {
+		t.Errorf("adding a fourth shard moved %d of %d blocks", moved, n)
+	}
+
+	// With a migration period, moved blocks are read from
+	// their old shard and copied to the new one.
+	added := NewMemStore()
+	if err := s.AddShard("shard3", added, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Migrating() {
+		t.Error("expected migration in progress")
+	}
+	if got := countReadable(t, s, scores); got != n {
+		t.Errorf("during migration: read %d of %d blocks", got, n)
+	}
+	if added.Len() != moved {
+		t.Errorf("migrated %d blocks, want %d", added.Len(), moved)
+	}
+	s.EndMigration()
+	if got := countReadable(t, s, scores); got != n {
+		t.Errorf("after migration: read %d of %d blocks", got, n)
+	}
+}
+
+func TestShardedStoreMigrationExpires(t *testing.T) {
+	s := NewShardedStore(0)
+	s.AddShard("a", NewMemStore(), 0)
+	scores := writeTestBlocks(t, s, 100)
+
+	s.AddShard("b", NewMemStore(), 10*time.Millisecond)
+	if !s.Migrating() {
+		t.Fatal("expected migration in progress")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s.Migrating() {
+		t.Error("migration did not expire")
+	}
+	if got := countReadable(t, s, scores); got == 100 {
+		t.Error("all blocks readable after migration expired")
+	}
+}
+
+type syncStore struct {
+	*MemStore
+	synced int
+	err    error
+}
+
+func (s *syncStore) Sync(ctx context.Context) error {
+	s.synced++
+	return s.err
+}
+
+func TestShardedStoreSync(t *testing.T) {
+	s := NewShardedStore(0)
+	stores := []*syncStore{
+		{MemStore: NewMemStore()},
+		{MemStore: NewMemStore(), err: errors.New("disk full")},
+		{MemStore: NewMemStore()},
+	}
+	for i, st := range stores {
+		s.AddShard(fmt.Sprintf("shard%d", i), st, 0)
+	}
+
+	err := s.Sync(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "shard1: disk full") {
+		t.Errorf("got %v, want error from shard1", err)
+	}
+	for i, st := range stores {
+		if st.synced != 1 {
+			t.Errorf("shard%d synced %d times", i, st.synced)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package venti
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 )
@@ -14,60 +16,189 @@ const (
 	DefaultPointerSize = DefaultDataSize - (DefaultDataSize % ScoreSize)
 )
 
+// DefaultReadAhead is the default number of data blocks a
+// SourceReader fetches in parallel. With one, each block is
+// fetched only once the previous one has been read.
+const DefaultReadAhead = 1
+
+// A ReaderOption configures a SourceReader.
+type ReaderOption func(*readerConfig)
+
+type readerConfig struct {
+	readAhead int
+	maxMemory int
+}
+
+// WithReadAhead sets the number of data blocks fetched in
+// parallel, including the one being read. Blocks are still
+// delivered in order.
+func WithReadAhead(n int) ReaderOption {
+	return func(c *readerConfig) {
+		c.readAhead = n
+	}
+}
+
+// WithReadAheadMemory limits the read-ahead window so that the
+// block buffers of the reader use at most n bytes, but always
+// allows at least one block.
+func WithReadAheadMemory(n int) ReaderOption {
+	return func(c *readerConfig) {
+		c.maxMemory = n
+	}
+}
+
+// A SourceReader reads the data of the source described by
+// an Entry. Data blocks are read sequentially, in a pipeline which
+// streams scores down from the pointer blocks and fetches a window
+// of data blocks ahead of the reader. Seek restarts the pipeline
+// from the block containing the new offset.
+//
+// The pipeline runs until the source has been read, an error
+// occurs, or the reader is closed. A reader which is not read to
+// the end must be closed.
 type SourceReader struct {
 	ctx context.Context
 
-	br BlockReader
-	e  Entry
+	br        BlockReader
+	e         Entry
+	readAhead int
+
+	// the current pipeline, started by the first Read
+	cancel context.CancelFunc
+	perr   *firstError     // the first error in the pipeline
+	blocks chan *dataBlock // data blocks, in order
+	free   chan []byte     // data block buffers no longer in use
+	block  int64           // the data block the pipeline starts from
+	next   int64           // offset of the next block from the pipeline
+
+	pos int64      // offset of the next byte returned by Read
+	cur *dataBlock // the block being read
+	off int
+	end int
+	err error // sticky until the next Seek
+
+	closed bool
+}
 
-	scores chan *Score
-	buf    []byte
-	off    int
-	end    int
+// A dataBlock is a data block being fetched by the pipeline.
+type dataBlock struct {
+	done chan struct{} // closed once the fetch completes
+	buf  []byte
+	n    int // the number of bytes of data in buf
+	err  error
 }
 
-func NewReader(ctx context.Context, br BlockReader, e Entry) *SourceReader {
+func NewReader(ctx context.Context, br BlockReader, e Entry, opts ...ReaderOption) *SourceReader {
+	cfg := readerConfig{readAhead: DefaultReadAhead}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.maxMemory > 0 && e.Dsize > 0 {
+		if max := cfg.maxMemory / e.Dsize; cfg.readAhead > max {
+			cfg.readAhead = max
+		}
+	}
+	if cfg.readAhead < 1 {
+		cfg.readAhead = 1
+	}
+
 	r := SourceReader{
-		ctx:    ctx,
-		br:     br,
-		e:      e,
-		scores: make(chan *Score),
-		buf:    make([]byte, e.Dsize),
+		ctx:       ctx,
+		br:        br,
+		e:         e,
+		readAhead: cfg.readAhead,
 	}
-	go r.readBlocks()
 
 	return &r
 }
 
 func (r *SourceReader) Read(p []byte) (int, error) {
-	if r.off != r.end {
-		// bytes already buffered from last venti read
-		n := copy(p, r.buf[r.off:r.end])
-		r.off += n
-		return n, nil
+	for r.off == r.end {
+		if err := r.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	// copy some or all of the block into p
+	n := copy(p, r.cur.buf[r.off:r.end])
+	r.off += n
+	r.pos += int64(n)
+	return n, nil
+}
+
+// nextBlock receives the next data block from the pipeline, starting
+// the pipeline if needed, and positions the reader at r.pos within the
+// block, or at its end if r.pos is beyond it.
+func (r *SourceReader) nextBlock() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.next >= r.e.Size {
+		if r.cancel != nil {
+			// stop reading any trailing empty leaves
+			r.cancel()
+		}
+		return io.EOF
+	}
+	if r.blocks == nil {
+		r.startPipeline()
+	}
+	if r.cur != nil {
+		// the free list has room for every buffer
+		r.free <- r.cur.buf
+		r.cur = nil
 	}
 
-	// fetch block from venti
+	// receive the next block from the pipeline
+	var b *dataBlock
 	select {
-	case s, ok := <-r.scores:
+	case bb, ok := <-r.blocks:
 		if !ok {
-			return 0, io.EOF
-		}
-		n, err := r.br.ReadBlock(r.ctx, *s, r.e.BaseType(), r.buf)
-		if err != nil {
-			return 0, err
+			if err := r.perr.get(); err != nil {
+				r.err = err
+				return err
+			}
+			return io.EOF
 		}
-		r.off = 0
-		r.end = n
+		b = bb
+	case <-r.ctx.Done():
+		return r.stop(r.ctx.Err())
+	}
+	select {
+	case <-b.done:
 	case <-r.ctx.Done():
-		// TODO: cleanup
-		return 0, r.ctx.Err()
+		return r.stop(r.ctx.Err())
+	}
+	if b.err != nil {
+		// report the cause if the pipeline failed
+		// and cancelled this fetch
+		if err := r.perr.get(); err != nil {
+			return r.stop(err)
+		}
+		return r.stop(b.err)
 	}
 
-	// copy some or all of the block into p
-	n := copy(p, r.buf[r.off:r.end])
-	r.off += n
-	return n, nil
+	start := r.next
+	n := b.n
+	if rem := r.e.Size - start; rem < int64(n) {
+		n = int(rem)
+	}
+	r.next += int64(n)
+	r.cur = b
+	r.end = n
+	r.off = n
+	if r.pos < r.next {
+		r.off = int(r.pos - start)
+	}
+	return nil
+}
+
+// stop records err as the reader's sticky error,
+// and shuts down the pipeline.
+func (r *SourceReader) stop(err error) error {
+	r.err = err
+	r.cancel()
+	return err
 }
 
 // ReadFrom copys blocks from r to w, using the configured blocksize.
@@ -99,58 +230,251 @@ func (r *SourceReader) WriteTo(w io.Writer) (written int64, err error) {
 	return written, err
 }
 
-func (r SourceReader) Seek(off int64, whence int) (int64, error) {
-	panic("TODO")
+// Close stops the reader's pipeline. Reads after
+// Close return an error. Close always returns nil.
+func (r *SourceReader) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	r.blocks = nil
+	r.free = nil
+	r.cur = nil
+	r.off, r.end = 0, 0
+	r.closed = true
+	r.err = errReaderClosed
+	return nil
 }
 
-func (r *SourceReader) readBlocks() {
-	depth := r.e.Depth()
-	if depth > 0 {
-		var in, out chan *Score
-
-		in = make(chan *Score)
-		// TODO: buffered channel instead of goroutine here?
-		go func(in chan *Score) {
-			in <- &r.e.Score
-			close(in)
-		}(in)
-		for i := 0; i < depth; i++ {
-			t := r.e.Type - BlockType(i)
-			out = make(chan *Score)
-			go func(in, out chan *Score, t BlockType) {
-				if err := r.unpackPointerBlocks(in, out, t); err != nil {
-					panic(err) // TODO
-				}
-				close(out)
-			}(in, out, t)
-			in = out
+var errReaderClosed = errors.New("read from closed SourceReader")
+
+// Seek sets the offset for the next Read, as described by io.Seeker.
+// Seeking within the current block is free; otherwise the next Read
+// fetches only the pointer blocks on the path to the new offset.
+// Offsets relative to io.SeekEnd are relative to the Entry's Size.
+func (r *SourceReader) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += r.pos
+	case io.SeekEnd:
+		off += r.e.Size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if off < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	if r.closed {
+		return 0, errReaderClosed
+	}
+
+	// the start of the buffered block
+	bstart := r.pos - int64(r.off)
+	if r.end > 0 && off >= bstart && off < bstart+int64(r.end) {
+		r.off = int(off - bstart)
+		r.pos = off
+		return off, nil
+	}
+
+	r.restart(off)
+	return off, nil
+}
+
+// startPipeline starts the goroutines which read pointer
+// blocks and fetch data blocks, starting at r.block.
+func (r *SourceReader) startPipeline() {
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(r.ctx)
+	r.perr = &firstError{cancel: r.cancel}
+	scores := make(chan *Score)
+	r.blocks = make(chan *dataBlock, r.readAhead)
+	r.free = make(chan []byte, r.readAhead)
+	go r.readBlocks(ctx, r.perr, scores, r.block)
+	go r.fetchBlocks(ctx, scores, r.blocks, r.free)
+}
+
+// restart stops the current pipeline, if any, so that the
+// next Read starts a new one at the data block containing off.
+func (r *SourceReader) restart(off int64) {
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	r.blocks = nil
+	r.free = nil
+	r.cur = nil
+	r.err = nil
+	r.block = off / int64(r.e.Dsize)
+	r.next = r.block * int64(r.e.Dsize)
+	r.pos = off
+	r.off, r.end = 0, 0
+}
+
+// fetchBlocks starts fetching the data block for each score received
+// on scores, and sends the pending blocks to blocks in order. Each
+// fetch uses a buffer from free, or a new one while fewer than
+// r.readAhead buffers exist, which bounds the read-ahead window.
+func (r *SourceReader) fetchBlocks(ctx context.Context, scores <-chan *Score, blocks chan<- *dataBlock, free chan []byte) {
+	defer close(blocks)
+
+	var nbufs int
+	for s := range scores {
+		var buf []byte
+		if nbufs < r.readAhead {
+			select {
+			case buf = <-free:
+			default:
+				buf = make([]byte, r.e.Dsize)
+				nbufs++
+			}
+		} else {
+			select {
+			case buf = <-free:
+			case <-ctx.Done():
+				return
+			}
 		}
-		for score := range out {
-			r.scores <- score
+
+		b := &dataBlock{
+			done: make(chan struct{}),
+			buf:  buf,
 		}
-	} else {
+		go r.fetchBlock(ctx, b, *s)
+
+		select {
+		case blocks <- b:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchBlock reads a data block into b.buf, zero-extending it
+// to Dsize.
+func (r *SourceReader) fetchBlock(ctx context.Context, b *dataBlock, s Score) {
+	defer close(b.done)
+
+	var n int
+	if s != ZeroScore() {
+		n, b.err = r.br.ReadBlock(ctx, s, r.e.BaseType(), b.buf)
+		if b.err != nil {
+			return
+		}
+	}
+	memset(b.buf[n:], 0)
+	b.n = r.e.Dsize
+}
+
+// numBlocks returns the number of data blocks in the source.
+func (r *SourceReader) numBlocks() int64 {
+	dsize := int64(r.e.Dsize)
+	return (r.e.Size + dsize - 1) / dsize
+}
+
+// blockPath returns the index of the pointer to follow at each
+// level of a tree of the given depth and fanout, from the root
+// down, to reach data block b.
+func blockPath(b int64, depth, fanout int) []int64 {
+	path := make([]int64, depth)
+	for i := depth - 1; i >= 0; i-- {
+		if i == 0 {
+			path[i] = b
+		} else {
+			path[i] = b % int64(fanout)
+			b /= int64(fanout)
+		}
+	}
+	return path
+}
+
+// readBlocks sends the scores of the source's data blocks to
+// scores, starting from data block b and ending with the last
+// block within the source's Size. Errors are reported to perr,
+// which stops the pipeline.
+func (r *SourceReader) readBlocks(ctx context.Context, perr *firstError, scores chan *Score, b int64) {
+	defer close(scores)
+
+	nblocks := r.numBlocks() - b
+	if nblocks <= 0 {
+		return
+	}
+
+	depth := r.e.Depth()
+	if depth == 0 {
 		// single-block source, just send it
-		r.scores <- &r.e.Score
+		if b == 0 {
+			select {
+			case scores <- &r.e.Score:
+			case <-ctx.Done():
+			}
+		}
+		return
 	}
 
-	// signal EOF
-	close(r.scores)
+	// the pointer stages stop once the last block has been sent
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// TODO: buffered channel instead of goroutine here?
+	in := make(chan *Score, 1)
+	in <- &r.e.Score
+	close(in)
 
-	return
+	path := blockPath(b, depth, r.e.Psize/ScoreSize)
+	var out chan *Score
+	for i := 0; i < depth; i++ {
+		t := r.e.Type - BlockType(i)
+		out = make(chan *Score)
+		go func(in, out chan *Score, t BlockType, skip int64) {
+			defer close(out)
+			if err := r.unpackPointerBlocks(ctx, in, out, t, skip); err != nil && ctx.Err() == nil {
+				perr.set(err)
+			}
+		}(in, out, t, path[i])
+		in = out
+	}
+	for score := range out {
+		select {
+		case scores <- score:
+		case <-ctx.Done():
+			return
+		}
+		if nblocks--; nblocks == 0 {
+			return
+		}
+	}
 }
 
-func (r *SourceReader) unpackPointerBlocks(in, out chan *Score, t BlockType) error {
+// unpackPointerBlocks reads the pointer blocks whose scores are
+// received on in, and sends the scores they contain to out,
+// skipping the first skip scores of the first block. Each block
+// is zero-extended, so missing trailing scores and the blocks
+// beneath a zero score are sent as zero scores.
+func (r *SourceReader) unpackPointerBlocks(ctx context.Context, in, out chan *Score, t BlockType, skip int64) error {
 	buf := make([]byte, r.e.Psize)
+	fanout := r.e.Psize / ScoreSize
 	for score := range in {
-		n, err := r.br.ReadBlock(r.ctx, *score, t, buf)
-		if err != nil {
+		var n int
+		if *score != ZeroScore() {
+			var err error
+			n, err = r.br.ReadBlock(ctx, *score, t, buf)
+			if err != nil {
+				return err
+			}
+		}
+		if err := ZeroExtend(t, buf, n, fanout*ScoreSize); err != nil {
 			return err
 		}
-		nentries := n / ScoreSize
-		for i := 0; i < nentries; i++ {
-			s := unpackScore(buf, i)
-			out <- &s
+		for i := skip; i < int64(fanout); i++ {
+			s := unpackScore(buf, int(i))
+			select {
+			case out <- &s:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
+		skip = 0
 	}
 	return nil
 }
@@ -161,6 +485,60 @@ func unpackScore(buf []byte, i int) Score {
 	return s
 }
 
+// A WriterOption configures a SourceWriter.
+type WriterOption func(*writerConfig)
+
+type writerConfig struct {
+	sparse bool
+
+	concurrency int
+}
+
+// WithSparse enables sparse mode, in which pointer blocks are
+// zero truncated like data blocks, so a pointer block holding
+// only zero scores collapses to the zero score. A run of zeros
+// spanning whole pointer blocks then costs no writes at all.
+//
+// Sparse mode changes the scores of sources with such runs,
+// so sources written with and without it do not share blocks.
+func WithSparse() WriterOption {
+	return func(c *writerConfig) {
+		c.sparse = true
+	}
+}
+
+// DefaultWriteConcurrency is the default number of data blocks
+// a SourceWriter writes in parallel. With one, each block is
+// written before the writer moves on.
+const DefaultWriteConcurrency = 1
+
+// WithWriteConcurrency sets the number of data blocks written in
+// parallel. Their scores are still added to the tree in order, so
+// the source is the same as when written serially. The writer then
+// holds up to n+1 data blocks in memory.
+func WithWriteConcurrency(n int) WriterOption {
+	return func(c *writerConfig) {
+		c.concurrency = n
+	}
+}
+
+// A HoleReader is a Reader which can skip runs of zeros, such as
+// the holes in a sparse file, without reading them. ReadHole skips
+// the run of zeros at the current offset, if any, and returns its
+// length. SourceWriter.ReadFrom calls ReadHole before each Read.
+type HoleReader interface {
+	io.Reader
+	ReadHole() (int64, error)
+}
+
+// A SourceWriter writes a source: a tree of data blocks of up to
+// dsize bytes, beneath pointer blocks of up to psize bytes. Data
+// is buffered into full blocks, so every data block but the last
+// holds dsize bytes, before zero truncation. Zero-truncated blocks
+// are empty, and have the zero score without being written.
+//
+// Once a write fails, the error is returned by every following
+// Write and by Flush.
 type SourceWriter struct {
 	ctx context.Context
 
@@ -168,14 +546,25 @@ type SourceWriter struct {
 	psize    int
 	dsize    int
 	baseType BlockType
+	sparse   bool
+
+	buf     []byte // the pending data block
+	size    int64
+	maxSize int64
+
+	// data block writes in flight, oldest first, when
+	// writing in parallel, and their spare buffers
+	concurrency int
+	inflight    []*pendingWrite
+	free        [][]byte
 
-	depth    int
-	size     int64
-	pointers []chan *Score
-	wg       sync.WaitGroup
+	// levels[i] holds the scores of the pending pointer block
+	// at depth i+1, where depth 0 is the data blocks.
+	levels [][]byte
+	err    error
 }
 
-func NewWriter(ctx context.Context, bw BlockWriter, t BlockType, psize, dsize int) *SourceWriter {
+func NewWriter(ctx context.Context, bw BlockWriter, t BlockType, psize, dsize int, opts ...WriterOption) *SourceWriter {
 	if dsize <= 0 {
 		panic("bad dsize")
 	}
@@ -186,51 +575,205 @@ func NewWriter(ctx context.Context, bw BlockWriter, t BlockType, psize, dsize in
 		panic("bad type")
 	}
 
+	cfg := writerConfig{concurrency: DefaultWriteConcurrency}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+
 	w := SourceWriter{
 		ctx:      ctx,
 		bw:       bw,
 		psize:    psize,
 		dsize:    dsize,
 		baseType: t,
+		sparse:   cfg.sparse,
+		buf:      make([]byte, 0, dsize),
+		maxSize:  MaxSize(psize, dsize),
+
+		concurrency: cfg.concurrency,
 	}
 
 	return &w
 }
 
-// Write adds a block of size len(p) to the current source.
+// NewAppender returns a SourceWriter which continues the source
+// described by e, as if the writer had written its data and not yet
+// been flushed. Only the right edge of the tree is read: the partial
+// pointer blocks on the path to the last data block, and the last
+// data block, if partial. Flush then returns an Entry for the longer
+// source, identical to one written all at once with the same opts.
+func NewAppender(ctx context.Context, br BlockReader, bw BlockWriter, e Entry, opts ...WriterOption) (*SourceWriter, error) {
+	w := NewWriter(ctx, bw, e.BaseType(), e.Psize, e.Dsize, opts...)
+	if max := treeSize(e.Psize, e.Dsize, e.Depth()); e.Size > max {
+		return nil, fmt.Errorf("append: size %d exceeds %d, the capacity of a depth %d tree", e.Size, max, e.Depth())
+	}
+	w.size = e.Size
+	r := NewReaderAt(br, e)
+
+	// the completed blocks at each level, and the pending
+	// scores of those which are not yet in a full pointer block
+	fanout := int64(e.Psize / ScoreSize)
+	k := e.Size / int64(e.Dsize)
+	for level := 0; k > 0; level++ {
+		block := make([]byte, 0, e.Psize)
+		for i := k - k%fanout; i < k; i++ {
+			s, err := r.nodeScore(ctx, level, i)
+			if err != nil {
+				return nil, fmt.Errorf("append: read pointers: %w", err)
+			}
+			block = append(block, s.Bytes()...)
+		}
+		w.levels = append(w.levels, block)
+		k /= fanout
+	}
+
+	if n := int(e.Size % int64(e.Dsize)); n > 0 {
+		buf := make([]byte, e.Dsize)
+		if _, err := r.readBlock(ctx, e.Size/int64(e.Dsize), 0, buf); err != nil {
+			return nil, fmt.Errorf("append: read last block: %w", err)
+		}
+		w.buf = append(w.buf, buf[:n]...)
+	}
+	return w, nil
+}
+
+// Write appends p to the current source, writing each
+// data block to venti as it is filled. If the source would
+// grow beyond MaxSize, nothing is written, and the error
+// wraps ErrTooLarge.
 func (w *SourceWriter) Write(p []byte) (int, error) {
-	if w.pointers == nil {
-		// clean state; this is a new or flushed writer.
-		w.pointers = make([]chan *Score, 10)
-		w.pointers[0] = make(chan *Score, 1)
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.checkSize(int64(len(p))); err != nil {
+		return 0, err
 	}
 
-	// write data blocks to venti and pass resulting scores
-	// to a pointer block writer goroutine.
-	o := p
+	var n int
 	for len(p) > 0 {
-		block := p
-		if len(block) > w.dsize {
-			block = block[:w.dsize]
+		m := copy(w.buf[len(w.buf):w.dsize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		w.size += int64(m)
+
+		if len(w.buf) == w.dsize {
+			if err := w.flushData(); err != nil {
+				return n - m, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// WriteHole appends n zero bytes to the current source. Whole
+// zero data blocks are added as zero scores, without allocating
+// or scanning them, and in sparse mode so are whole zero pointer
+// blocks. The resulting source is identical to one written with
+// Write.
+func (w *SourceWriter) WriteHole(n int64) error {
+	if w.err != nil {
+		return w.err
+	}
+	if n < 0 {
+		return errors.New("write hole: negative size")
+	}
+	if err := w.checkSize(n); err != nil {
+		return err
+	}
+	// complete the pending data block
+	if len(w.buf) > 0 {
+		m := w.dsize - len(w.buf)
+		if int64(m) > n {
+			m = int(n)
 		}
-		p = p[len(block):]
+		w.zeroFill(m)
+		n -= int64(m)
+		if len(w.buf) == w.dsize {
+			if err := w.flushData(); err != nil {
+				return err
+			}
+		}
+	}
+
+	dsize := int64(w.dsize)
+	if err := w.batchHoles(n / dsize); err != nil {
+		return err
+	}
+	w.size += n / dsize * dsize
+	w.zeroFill(int(n % dsize))
+	return nil
+}
+
+// checkSize returns an error if n more bytes would
+// make the source larger than the tree can hold.
+func (w *SourceWriter) checkSize(n int64) error {
+	if n > w.maxSize-w.size {
+		return fmt.Errorf("write: %w: %d bytes at offset %d exceeds the maximum of %d",
+			ErrTooLarge, n, w.size, w.maxSize)
+	}
+	return nil
+}
 
-		// TODO: is this the right place to do this? it seems to mess up the
-		// nwritten return value and w.size.
-		block = ZeroTruncate(w.baseType, block)
+// zeroFill appends n zeros to the pending data block.
+func (w *SourceWriter) zeroFill(n int) {
+	m := len(w.buf)
+	w.buf = w.buf[:m+n]
+	memset(w.buf[m:], 0)
+	w.size += int64(n)
+}
 
-		s := w.writeBlock(block, w.baseType, 0)
-		w.pointers[0] <- &s
+// batchHoles adds n zero data blocks to the tree. In sparse mode,
+// a run of zero blocks filling a pointer block is added as a zero
+// score at the level above, as it would be zero truncated.
+func (w *SourceWriter) batchHoles(n int64) error {
+	// the holes follow the blocks being written
+	if err := w.finishWrites(); err != nil {
+		return err
 	}
 
-	w.size += int64(len(o))
-	return len(o), nil
+	fanout := int64(w.psize / ScoreSize)
+	for n > 0 {
+		level, span := 0, int64(1)
+		for w.sparse && span*fanout <= n {
+			if level < len(w.levels) && len(w.levels[level]) > 0 {
+				break
+			}
+			level++
+			span *= fanout
+		}
+		for len(w.levels) < level {
+			w.levels = append(w.levels, make([]byte, 0, w.psize))
+		}
+		if err := w.batchPointers(level, ZeroScore()); err != nil {
+			return err
+		}
+		n -= span
+	}
+	return nil
 }
 
 // ReadFrom copys blocks from r to w, using the configured blocksize.
+// If r is a HoleReader, its holes are added with WriteHole.
 func (w *SourceWriter) ReadFrom(r io.Reader) (read int64, err error) {
+	hr, _ := r.(HoleReader)
 	buf := make([]byte, w.dsize)
 	for {
+		if hr != nil {
+			nh, eh := hr.ReadHole()
+			if eh != nil {
+				return read, eh
+			}
+			if nh > 0 {
+				if err := w.WriteHole(nh); err != nil {
+					return read, err
+				}
+				read += nh
+			}
+		}
 		nr, er := r.Read(buf)
 		if nr > 0 {
 			read += int64(nr)
@@ -254,68 +797,235 @@ func (w *SourceWriter) ReadFrom(r io.Reader) (read int64, err error) {
 	return read, err
 }
 
-func (w *SourceWriter) writeBlock(block []byte, t BlockType, depth int) Score {
-	score, err := w.bw.WriteBlock(w.ctx, t, block)
+// flushData writes the pending data block, and adds
+// its score to the lowest pointer block.
+func (w *SourceWriter) flushData() error {
+	block := ZeroTruncate(w.baseType, w.buf)
+	if w.concurrency > 1 {
+		return w.startWrite(block)
+	}
+	s, err := w.writeBlock(block, w.baseType)
 	if err != nil {
-		panic("TODO")
+		return err
+	}
+	w.buf = w.buf[:0]
+	return w.batchPointers(0, s)
+}
+
+// A pendingWrite is a data block being written in parallel.
+type pendingWrite struct {
+	done  chan struct{} // closed once the write completes
+	buf   []byte
+	score Score
+	err   error
+}
+
+// startWrite writes block, which is held in w.buf, in a new
+// goroutine, once fewer than w.concurrency writes are in flight.
+// w.buf is replaced, as the write owns it until it completes.
+func (w *SourceWriter) startWrite(block []byte) error {
+	if len(w.inflight) == w.concurrency {
+		if err := w.finishWrite(); err != nil {
+			return err
+		}
+	}
+
+	p := &pendingWrite{
+		done: make(chan struct{}),
+		buf:  w.buf,
 	}
+	w.inflight = append(w.inflight, p)
+	go func() {
+		p.score, p.err = w.putBlock(block, w.baseType)
+		close(p.done)
+	}()
+
+	if n := len(w.free); n > 0 {
+		w.buf = w.free[n-1]
+		w.free = w.free[:n-1]
+	} else {
+		w.buf = make([]byte, 0, w.dsize)
+	}
+	return nil
+}
 
-	if w.depth == depth && len(w.pointers[depth]) == 1 {
-		w.depth++
-		w.wg.Add(1)
-		w.pointers[w.depth] = make(chan *Score, 1)
-		go w.batchPointers(w.depth)
+// finishWrite waits for the oldest write in flight, and adds its
+// score to the tree. If it failed, the other writes are abandoned.
+func (w *SourceWriter) finishWrite() error {
+	p := w.inflight[0]
+	<-p.done
+	w.inflight = w.inflight[1:]
+	w.free = append(w.free, p.buf[:0])
+	if p.err != nil {
+		w.abandonWrites()
+		w.err = fmt.Errorf("write %v block: %w", w.baseType, p.err)
+		return w.err
 	}
+	return w.batchPointers(0, p.score)
+}
 
-	return score
+// abandonWrites waits for the writes in flight, discarding
+// their scores, so that none outlive a failed writer.
+func (w *SourceWriter) abandonWrites() {
+	for _, p := range w.inflight {
+		<-p.done
+	}
+	w.inflight = nil
 }
 
-func (w *SourceWriter) batchPointers(depth int) {
-	input, output := w.pointers[depth-1], w.pointers[depth]
-	t := w.baseType + BlockType(depth)
-	block := make([]byte, 0, w.psize)
-	for score := range input {
-		block = append(block, score.Bytes()...)
-		if len(block)+ScoreSize > w.psize {
-			s := w.writeBlock(block, t, depth)
-			output <- &s
-			block = block[:0]
+// finishWrites waits for all of the writes in flight.
+func (w *SourceWriter) finishWrites() error {
+	for len(w.inflight) > 0 {
+		if err := w.finishWrite(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// batchPointers adds s to the pending pointer block at the given
+// level, writing the block once it is full and adding its score
+// to the level above.
+func (w *SourceWriter) batchPointers(level int, s Score) error {
+	if level == MaxDepth && level < len(w.levels) && len(w.levels[level]) > 0 {
+		// a second score above the root; checkSize should
+		// have stopped the writes long before this
+		return w.tooDeep()
+	}
+	if level == len(w.levels) {
+		w.levels = append(w.levels, make([]byte, 0, w.psize))
+	}
+	block := append(w.levels[level], s.Bytes()...)
+	w.levels[level] = block
+	if len(block)+ScoreSize <= w.psize {
+		return nil
+	}
+
+	ps, err := w.writeBlock(block, w.baseType+BlockType(level+1))
+	if err != nil {
+		return err
+	}
+	w.levels[level] = block[:0]
+	return w.batchPointers(level+1, ps)
+}
 
-	if len(block) > 0 {
-		s := w.writeBlock(block, t, depth)
-		output <- &s
+func (w *SourceWriter) tooDeep() error {
+	w.abandonWrites()
+	w.err = fmt.Errorf("write: %w: the tree is deeper than %d", ErrTooLarge, MaxDepth)
+	return w.err
+}
+
+func (w *SourceWriter) writeBlock(block []byte, t BlockType) (Score, error) {
+	s, err := w.putBlock(block, t)
+	if err != nil {
+		w.abandonWrites()
+		w.err = fmt.Errorf("write %v block: %w", t, err)
+		return Score{}, w.err
 	}
+	return s, nil
+}
 
-	close(w.pointers[depth])
-	w.wg.Done()
+// putBlock writes a block. It is safe to call from
+// the goroutines writing data blocks in parallel.
+func (w *SourceWriter) putBlock(block []byte, t BlockType) (Score, error) {
+	if w.sparse && t.depth() > 0 {
+		block = ZeroTruncate(t, block)
+	}
+	if len(block) == 0 {
+		return ZeroScore(), nil
+	}
+	return w.bw.WriteBlock(w.ctx, t, block)
 }
 
 // Flush finishes writing the current source, and returns
-// and Entry describing it.
+// and Entry describing it. The writer is then reset, and
+// may be used to write another source.
 func (w *SourceWriter) Flush() (Entry, error) {
-	// TODO: check errors
+	defer w.reset()
 
-	if w.pointers == nil {
-		panic("no writes to flush")
+	if w.err != nil {
+		return Entry{}, w.err
+	}
+	if err := w.finishWrites(); err != nil {
+		return Entry{}, err
+	}
+	if len(w.buf) > 0 || len(w.levels) == 0 {
+		// the last data block, which may be empty
+		if err := w.flushData(); err != nil {
+			return Entry{}, err
+		}
+		if err := w.finishWrites(); err != nil {
+			return Entry{}, err
+		}
 	}
 
-	close(w.pointers[0])
-	w.wg.Wait()
+	// Write the partial pointer blocks from the bottom up, until
+	// a level holds a single score: the root of the tree.
+	var score Score
+	var depth int
+	for i := 0; ; i++ {
+		block := w.levels[i]
+		if i == len(w.levels)-1 && len(block) == ScoreSize {
+			copy(score[:], block)
+			depth = i
+			break
+		}
+		if len(block) == 0 {
+			continue
+		}
+		if i == MaxDepth {
+			return Entry{}, w.tooDeep()
+		}
+		ps, err := w.writeBlock(block, w.baseType+BlockType(i+1))
+		if err != nil {
+			return Entry{}, err
+		}
+		w.levels[i] = block[:0]
+		if i+1 == len(w.levels) {
+			w.levels = append(w.levels, make([]byte, 0, w.psize))
+		}
+		w.levels[i+1] = append(w.levels[i+1], ps.Bytes()...)
+	}
 
 	e := Entry{
 		Psize: w.psize,
 		Dsize: w.dsize,
-		Type:  w.baseType + BlockType(w.depth),
+		Type:  w.baseType + BlockType(depth),
 		Flags: EntryActive,
 		Size:  w.size,
-		Score: *<-w.pointers[w.depth],
+		Score: score,
 	}
+	return e, nil
+}
 
-	w.pointers = nil
-	w.depth = 0
+func (w *SourceWriter) reset() {
+	w.buf = w.buf[:0]
 	w.size = 0
+	w.levels = nil
+	w.abandonWrites()
+	w.err = nil
+}
 
-	return e, nil
+// firstError records the first error reported by the
+// goroutines of a pipeline, and stops the pipeline.
+type firstError struct {
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+func (e *firstError) set(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+	e.cancel()
+}
+
+func (e *firstError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
 }
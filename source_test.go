@@ -3,9 +3,39 @@ package venti
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"testing"
+	"time"
+
+	"sigint.ca/venti2/internal/leaktest"
 )
 
+// testData returns n bytes of a pattern with no zeros.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i%255) + 1
+	}
+	return data
+}
+
+// writeSource writes data as a source with a SourceWriter.
+func writeSource(t *testing.T, bw BlockWriter, data []byte, psize, dsize int, opts ...WriterOption) Entry {
+	t.Helper()
+	w := NewWriter(context.Background(), bw, DataType, psize, dsize, opts...)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	e, err := w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
 func TestSourceIO(t *testing.T) {
 	ctx := context.Background()
 
@@ -14,7 +44,24 @@ func TestSourceIO(t *testing.T) {
 		t.Fatalf("dial venti: %v", err)
 	}
 
-	w := NewWriter(ctx, client, DataType, 3*ScoreSize, 20)
+	testSourceIO(t, ctx, client)
+
+	if err := client.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSourceIOMem(t *testing.T) {
+	testSourceIO(t, context.Background(), NewMemStore())
+}
+
+type blockReadWriter interface {
+	BlockReader
+	BlockWriter
+}
+
+func testSourceIO(t *testing.T, ctx context.Context, rw blockReadWriter) {
+	w := NewWriter(ctx, rw, DataType, 3*ScoreSize, 20)
 
 	type test struct {
 		s     []byte
@@ -41,7 +88,7 @@ func TestSourceIO(t *testing.T) {
 		t.Logf("flush returned entry with depth=%d", e.Depth())
 
 		var w bytes.Buffer
-		if _, err := NewReader(ctx, client, e).WriteTo(&w); err != nil {
+		if _, err := NewReader(ctx, rw, e).WriteTo(&w); err != nil {
 			t.Fatal(err)
 		}
 		buf := w.Bytes()
@@ -50,8 +97,614 @@ func TestSourceIO(t *testing.T) {
 			t.Errorf("read: got %q, want %q", buf, test.s)
 		}
 	}
+}
 
-	if err := client.Close(); err != nil {
-		t.Error(err)
+type countingReader struct {
+	BlockReader
+	mu    sync.Mutex
+	reads int
+}
+
+func (r *countingReader) ReadBlock(ctx context.Context, s Score, t BlockType, buf []byte) (int, error) {
+	r.mu.Lock()
+	r.reads++
+	r.mu.Unlock()
+	return r.BlockReader.ReadBlock(ctx, s, t, buf)
+}
+
+func (r *countingReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reads
+}
+
+func TestSourceSeek(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+
+	data := testData(1000)
+	e := writeSource(t, m, data, 3*ScoreSize, 20)
+	t.Logf("depth=%d", e.Depth())
+
+	cr := &countingReader{BlockReader: m}
+	r := NewReader(ctx, cr, e)
+	buf := make([]byte, 30)
+	for _, test := range []struct {
+		off    int64
+		whence int
+		pos    int64
+	}{
+		{0, io.SeekStart, 0},
+		{517, io.SeekStart, 517},
+		{-30, io.SeekCurrent, 517}, // after reading 30 bytes
+		{5, io.SeekCurrent, 552},   // within the buffered block
+		{-1, io.SeekEnd, 999},
+		{-600, io.SeekEnd, 400},
+		{39, io.SeekStart, 39},
+	} {
+		pos, err := r.Seek(test.off, test.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != test.pos {
+			t.Fatalf("seek(%d, %d): got position %d, want %d", test.off, test.whence, pos, test.pos)
+		}
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF && pos+int64(n) == int64(len(data)) {
+			err = nil
+		}
+		if err != nil {
+			t.Fatalf("read at %d: %v", pos, err)
+		}
+		if want := data[pos : pos+int64(n)]; !bytes.Equal(buf[:n], want) {
+			t.Errorf("read at %d: got %v, want %v", pos, buf[:n], want)
+		}
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seek to negative offset: expected error")
+	}
+	if _, err := r.Seek(2000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("read past end: got %d, %v", n, err)
+	}
+
+	// reading the end of the source costs one block per level
+	cr = &countingReader{BlockReader: m}
+	r = NewReader(ctx, cr, e)
+	if _, err := r.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if n := cr.count(); n != e.Depth()+1 {
+		t.Errorf("read %d blocks, want %d", n, e.Depth()+1)
+	}
+}
+
+type slowReader struct {
+	BlockReader
+	latency
+}
+
+func (r *slowReader) ReadBlock(ctx context.Context, s Score, t BlockType, buf []byte) (int, error) {
+	r.wait()
+	return r.BlockReader.ReadBlock(ctx, s, t, buf)
+}
+
+func TestSourceReadAhead(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+
+	data := testData(2000)
+	e := writeSource(t, m, data, 10*ScoreSize, 20)
+
+	for _, test := range []struct {
+		name string
+		opts []ReaderOption
+		max  int
+	}{
+		{"default", nil, DefaultReadAhead},
+		{"readahead", []ReaderOption{WithReadAhead(8)}, 8},
+		{"memory", []ReaderOption{WithReadAhead(8), WithReadAheadMemory(4 * 20)}, 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sr := &slowReader{BlockReader: m, latency: latency{delay: time.Millisecond}}
+			r := NewReader(ctx, sr, e, test.opts...)
+
+			var buf bytes.Buffer
+			if _, err := r.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Error("data differs")
+			}
+			// pointer blocks are read in parallel with data blocks
+			t.Logf("max %d reads in flight", sr.max)
+			if max := test.max + e.Depth(); sr.max > max {
+				t.Errorf("%d reads in flight, want at most %d", sr.max, max)
+			}
+			if test.max > 4 && sr.max < 4 {
+				t.Errorf("reads were not pipelined: max in flight %d", sr.max)
+			}
+		})
+	}
+}
+
+// faultyStore fails reads and writes of blocks of type fail
+// once after blocks have been written or read successfully.
+type faultyStore struct {
+	*MemStore
+	fail  BlockType
+	after int
+
+	mu sync.Mutex
+	n  int
+}
+
+var errInjected = errors.New("injected failure")
+
+func (s *faultyStore) fault(t BlockType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t != s.fail {
+		return false
+	}
+	s.n++
+	return s.n > s.after
+}
+
+func (s *faultyStore) ReadBlock(ctx context.Context, score Score, t BlockType, buf []byte) (int, error) {
+	if s.fault(t) {
+		return 0, errInjected
+	}
+	return s.MemStore.ReadBlock(ctx, score, t, buf)
+}
+
+func (s *faultyStore) WriteBlock(ctx context.Context, t BlockType, buf []byte) (Score, error) {
+	if s.fault(t) {
+		return Score{}, errInjected
+	}
+	return s.MemStore.WriteBlock(ctx, t, buf)
+}
+
+func TestSourceWriterErrors(t *testing.T) {
+	ctx := context.Background()
+	data := testData(1000)
+
+	for _, test := range []struct {
+		name        string
+		fail        BlockType
+		after       int
+		concurrency int
+	}{
+		{"data", DataType, 10, 1},
+		{"pointer", DataType + 1, 3, 1},
+		{"top", DataType + 3, 0, 1},
+		{"parallel data", DataType, 10, 4},
+		{"parallel pointer", DataType + 1, 3, 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+
+			s := &faultyStore{MemStore: NewMemStore(), fail: test.fail, after: test.after}
+			w := NewWriter(ctx, s, DataType, 3*ScoreSize, 20, WithWriteConcurrency(test.concurrency))
+			_, werr := w.Write(data)
+			_, ferr := w.Flush()
+			if !errors.Is(werr, errInjected) && !errors.Is(ferr, errInjected) {
+				t.Fatalf("got errors %v and %v, want %v", werr, ferr, errInjected)
+			}
+			if werr != nil && !errors.Is(ferr, errInjected) {
+				t.Errorf("flush after failed write: got %v, want %v", ferr, errInjected)
+			}
+			t.Logf("%v (expected)", errors.Join(werr, ferr))
+
+			// the writer is reset by Flush
+			s.fail = MaxType
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSourceWriteConcurrency(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx := context.Background()
+	data := testData(5000)
+	// zero blocks are not written, but keep their place
+	copy(data[1000:], make([]byte, 100))
+
+	for _, opts := range [][]WriterOption{
+		nil,
+		{WithSparse()},
+	} {
+		want := writeSource(t, NewMemStore(), data, 3*ScoreSize, 20, opts...)
+
+		sw := &slowWriter{latency: latency{delay: time.Millisecond}}
+		w := NewWriter(ctx, sw, DataType, 3*ScoreSize, 20, append(opts, WithWriteConcurrency(8))...)
+		// in small pieces, so writes span blocks
+		for p := data; len(p) > 0; {
+			n := 7
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		e, err := w.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e != want {
+			t.Errorf("parallel entry differs from serial:\n\twant=%+v,\n\t got=%+v", want, e)
+		}
+		if sw.max < 2 || sw.max > 8 {
+			t.Errorf("got %d concurrent writes, want 2 to 8", sw.max)
+		}
+	}
+}
+
+func TestSourceReaderErrors(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	data := testData(1000)
+	e := writeSource(t, m, data, 3*ScoreSize, 20)
+
+	for _, test := range []struct {
+		name  string
+		fail  BlockType
+		after int
+	}{
+		{"data", DataType, 10},
+		{"pointer", DataType + 1, 3},
+		{"root", e.Type, 0},
+	} {
+		for _, readAhead := range []int{1, 8} {
+			t.Run(fmt.Sprintf("%s/%d", test.name, readAhead), func(t *testing.T) {
+				defer leaktest.Check(t)()
+
+				s := &faultyStore{MemStore: m, fail: test.fail, after: test.after}
+				r := NewReader(ctx, s, e, WithReadAhead(readAhead))
+				n, err := io.Copy(io.Discard, r)
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("got %v, want %v", err, errInjected)
+				}
+				if n >= int64(len(data)) {
+					t.Errorf("read %d bytes before failing", n)
+				}
+				if _, err := r.Read(make([]byte, 10)); !errors.Is(err, errInjected) {
+					t.Errorf("read after error: got %v, want %v", err, errInjected)
+				}
+			})
+		}
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		defer leaktest.Check(t)()
+
+		ctx, cancel := context.WithCancel(ctx)
+		sr := &slowReader{BlockReader: m, latency: latency{delay: time.Millisecond}}
+		r := NewReader(ctx, sr, e, WithReadAhead(4))
+		if _, err := r.Read(make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if _, err := io.Copy(io.Discard, r); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestSourceReaderClose(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx := context.Background()
+	m := NewMemStore()
+	data := testData(1000)
+	e := writeSource(t, m, data, 3*ScoreSize, 20)
+
+	r := NewReader(ctx, m, e, WithReadAhead(4))
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("read after close: expected error")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err == nil {
+		t.Error("seek after close: expected error")
+	}
+
+	// closing an unread reader is harmless
+	if err := NewReader(ctx, m, e).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSourceZeroExtend(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	const psize, dsize = 3 * ScoreSize, 20
+
+	// zeros at the end of blocks, whole zero blocks,
+	// and a zero tail on the last block
+	data := make([]byte, 250)
+	for i := range data {
+		if i%dsize < 13 && (i < 60 || i >= 100) && i < 240 {
+			data[i] = byte(i%255) + 1
+		}
+	}
+	e := writeSource(t, m, data, psize, dsize)
+	got, err := io.ReadAll(NewReader(ctx, m, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("bad data:\n\twant=%v,\n\t got=%v", data, got)
+	}
+
+	// a depth-1 tree with a hole and missing trailing scores
+	block := bytes.Repeat([]byte{'x'}, 5)
+	s, err := m.WriteBlock(ctx, DataType, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := ZeroScore()
+	ptrs := append(zero.Bytes(), s.Bytes()...)
+	ps, err := m.WriteBlock(ctx, DataType+1, ptrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = Entry{
+		Psize: psize,
+		Dsize: dsize,
+		Type:  DataType + 1,
+		Flags: EntryActive,
+		Size:  55,
+		Score: ps,
+	}
+	want := make([]byte, 55)
+	copy(want[dsize:], block)
+	got, err = io.ReadAll(NewReader(ctx, m, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("bad data:\n\twant=%v,\n\t got=%v", want, got)
+	}
+
+	// reads stop at Size, even within a block
+	e.Size = 23
+	got, err = io.ReadAll(NewReader(ctx, m, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[:23]) {
+		t.Errorf("bad data:\n\twant=%v,\n\t got=%v", want[:23], got)
+	}
+}
+
+func TestSourceWriteHole(t *testing.T) {
+	ctx := context.Background()
+	const psize, dsize = 3 * ScoreSize, 20
+
+	// each write is data or, if zero, a hole
+	writes := []struct {
+		n    int
+		zero bool
+	}{
+		{7, false},
+		{5, true},
+		{30, false},
+		{1000, true},
+		{1, false},
+		{2000, true},
+		{45, false},
+		{3, true},
+	}
+
+	for _, sparse := range []bool{false, true} {
+		var opts []WriterOption
+		if sparse {
+			opts = append(opts, WithSparse())
+		}
+		m1, m2 := NewMemStore(), NewMemStore()
+		w1 := NewWriter(ctx, m1, DataType, psize, dsize, opts...)
+		w2 := NewWriter(ctx, m2, DataType, psize, dsize, opts...)
+		var data []byte
+		for i, wr := range writes {
+			p := make([]byte, wr.n)
+			if !wr.zero {
+				for j := range p {
+					p[j] = byte(i + j + 1)
+				}
+			}
+			data = append(data, p...)
+			if _, err := w1.Write(p); err != nil {
+				t.Fatal(err)
+			}
+			if wr.zero {
+				if err := w2.WriteHole(int64(wr.n)); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := w2.Write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		e1, err := w1.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e2, err := w2.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e1 != e2 {
+			t.Errorf("sparse=%v: WriteHole entry differs from Write:\n\twant=%+v,\n\t got=%+v", sparse, e1, e2)
+		}
+
+		got, err := io.ReadAll(NewReader(ctx, m2, e2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("sparse=%v: bad data:\n\twant=%v,\n\t got=%v", sparse, data, got)
+		}
+	}
+
+	// in sparse mode, a large hole costs nothing
+	m := NewMemStore()
+	w := NewWriter(ctx, m, DataType, DefaultPointerSize, DefaultDataSize, WithSparse())
+	if _, err := w.Write([]byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHole(1 << 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	e, err := w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != 1<<30+8 {
+		t.Errorf("bad size: got %d, want %d", e.Size, 1<<30+8)
+	}
+	if n := m.Len(); n > 2*(e.Depth()+1) {
+		t.Errorf("sparse source has %d blocks", n)
+	}
+	r := NewReaderAt(m, e)
+	buf := make([]byte, 8)
+	if _, err := r.ReadAt(buf, 1<<29); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, make([]byte, 8)) {
+		t.Errorf("hole is not zero: %v", buf)
+	}
+	if _, err := r.ReadAt(buf[:4], e.Size-4); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+	if string(buf[:4]) != "tail" {
+		t.Errorf("got %q, want %q", buf[:4], "tail")
+	}
+}
+
+func TestSourceAppend(t *testing.T) {
+	ctx := context.Background()
+	const psize, dsize = 3 * ScoreSize, 20
+	data := testData(2000)
+	// a hole spanning whole pointer blocks
+	copy(data[300:], make([]byte, 400))
+
+	for _, sparse := range []bool{false, true} {
+		var opts []WriterOption
+		if sparse {
+			opts = append(opts, WithSparse())
+		}
+		m := NewMemStore()
+		want := writeSource(t, m, data, psize, dsize, opts...)
+
+		for _, split := range []int{0, 1, 19, 20, 21, 60, 180, 181, 540, 701, 1999, 2000} {
+			e := writeSource(t, m, data[:split], psize, dsize, opts...)
+
+			cr := &countingReader{BlockReader: m}
+			a, err := NewAppender(ctx, cr, m, e, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := cr.count(); n > e.Depth()+1 {
+				t.Errorf("split %d: read %d blocks for a tree of depth %d", split, n, e.Depth())
+			}
+			if _, err := a.Write(data[split:]); err != nil {
+				t.Fatal(err)
+			}
+			got, err := a.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("sparse=%v, split %d: appended entry differs:\n\twant=%+v,\n\t got=%+v", sparse, split, want, got)
+			}
+		}
+	}
+}
+
+func TestSourceDepthLimit(t *testing.T) {
+	ctx := context.Background()
+	const psize, dsize = 3 * ScoreSize, 20
+	max := MaxSize(psize, dsize)
+	data := testData(int(max + 1))
+	m := NewMemStore()
+	buf := make([]byte, EntrySize)
+
+	// each tree size, and one byte more, at every depth
+	capacity := int64(dsize)
+	for depth := 0; depth <= MaxDepth; depth++ {
+		for _, size := range []int64{capacity, capacity + 1} {
+			want := depth
+			if size > capacity {
+				want++
+			}
+			if want > MaxDepth {
+				break
+			}
+			e := writeSource(t, m, data[:size], psize, dsize)
+			if e.Depth() != want {
+				t.Errorf("size %d: depth %d, want %d", size, e.Depth(), want)
+			}
+			if err := e.Pack(buf); err != nil {
+				t.Errorf("size %d: %v", size, err)
+			}
+		}
+		capacity *= int64(psize / ScoreSize)
+	}
+
+	// a full tree of MaxDepth, which can grow no further
+	w := NewWriter(ctx, m, DataType, psize, dsize)
+	if _, err := w.Write(data[:max]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[max:]); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Write beyond MaxSize: got %v, want ErrTooLarge", err)
+	}
+	if err := w.WriteHole(1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("WriteHole beyond MaxSize: got %v, want ErrTooLarge", err)
+	}
+	e, err := w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != max || e.Depth() != MaxDepth {
+		t.Errorf("got size %d and depth %d, want %d and %d", e.Size, e.Depth(), max, MaxDepth)
+	}
+	if err := NewWriter(ctx, m, DataType, psize, dsize).WriteHole(max + 1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("WriteHole beyond MaxSize: got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestSourceAppendBadEntry(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	e := writeSource(t, m, make([]byte, 100), 3*ScoreSize, 20)
+
+	// a corrupt size, beyond the capacity of the tree
+	e.Size = 1000
+	if _, err := NewAppender(ctx, m, m, e); err == nil {
+		t.Error("appended to an entry too large for its depth")
+	} else {
+		t.Logf("%v (expected)", err)
 	}
 }
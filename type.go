@@ -96,7 +96,7 @@ var fromDisk = []BlockType{
 }
 
 func (t BlockType) onDiskType() uint8 {
-	if int(t) > len(toDisk) {
+	if int(t) >= len(toDisk) {
 		return CorruptType
 	}
 	return toDisk[t]
@@ -217,15 +217,31 @@ func NewDirScanner(ctx context.Context, br venti.BlockReader, f *File) *DirScann
 	return &ds
 }
 
+// Scan advances to the next entry, which is then available through
+// DirEntry. It returns false, and closes the scanner, when there are
+// no more entries or an error occurs.
 func (ds *DirScanner) Scan() bool {
+	if ds.err != nil {
+		return false
+	}
 	de, err := ds.next()
-	if err != nil && ds.err == nil {
+	if err != nil {
 		ds.err = err
+		ds.r.Close()
 	}
 	ds.de = de
 	return ds.err == nil
 }
 
+// Close stops the scanner. It is only needed when
+// the scanner is abandoned before Scan returns false.
+func (ds *DirScanner) Close() error {
+	if ds.err == nil {
+		ds.err = io.EOF
+	}
+	return ds.r.Close()
+}
+
 func (ds *DirScanner) DirEntry() *DirEntry {
 	return ds.de
 }
@@ -248,7 +264,7 @@ func (ds *DirScanner) next() (*DirEntry, error) {
 			if err == io.EOF {
 				return nil, io.EOF
 			}
-			return nil, fmt.Errorf("read meta block: %v", err)
+			return nil, fmt.Errorf("read meta block: %w", err)
 		}
 
 		// TODO: why are there zero-sized meta blocks???
@@ -259,18 +275,18 @@ func (ds *DirScanner) next() (*DirEntry, error) {
 		memset(ds.mbuf[n:], 0)
 		mb, err := UnpackMetaBlock(ds.mbuf)
 		if err != nil {
-			return nil, fmt.Errorf("unpack meta block: %v", err)
+			return nil, fmt.Errorf("unpack meta block: %w", err)
 		}
 		ds.mb = mb
 		break
 	}
 	me, err := ds.mb.unpackMetaEntry(ds.i)
 	if err != nil {
-		return nil, fmt.Errorf("unpack meta entry: %v", err)
+		return nil, fmt.Errorf("unpack meta entry: %w", err)
 	}
 	de, err := ds.mb.unpackDirEntry(me)
 	if err != nil {
-		return nil, fmt.Errorf("unpack dir entry: %v", err)
+		return nil, fmt.Errorf("unpack dir entry: %w", err)
 	}
 
 	ds.i++
@@ -278,7 +294,9 @@ func (ds *DirScanner) next() (*DirEntry, error) {
 }
 
 type DirWriter struct {
-	bsize   int
+	msize   int // meta block size
+	epb     int // entries per block of source
+	pad     int // padding after each full block of entries
 	source  *venti.SourceWriter
 	msource *venti.SourceWriter
 	mb      *MetaBlock
@@ -286,43 +304,35 @@ type DirWriter struct {
 }
 
 func NewDirWriter(ctx context.Context, bw venti.BlockWriter, bsize int) *DirWriter {
-	psize := (bsize / venti.ScoreSize) * venti.ScoreSize
+	psize := venti.PointerSize(bsize)
+	msize := metaBlockSize(bsize)
 
 	dw := DirWriter{
-		bsize:   bsize,
+		msize:   msize,
+		epb:     bsize / venti.EntrySize,
+		pad:     bsize % venti.EntrySize,
 		source:  venti.NewWriter(ctx, bw, venti.DirType, psize, bsize),
-		msource: venti.NewWriter(ctx, bw, venti.DataType, psize, bsize),
+		msource: venti.NewWriter(ctx, bw, venti.DataType, venti.PointerSize(msize), msize),
 	}
 
 	return &dw
 }
 
 func (dw *DirWriter) Add(f *File) error {
-	buf := make([]byte, venti.EntrySize)
-	if err := f.source.Pack(buf); err != nil {
+	var err error
+	if f.meta.Entry, err = dw.writeEntry(f.source); err != nil {
 		return err
 	}
-	if _, err := dw.source.Write(buf); err != nil {
-		return err
-	}
-	f.meta.Entry = dw.i
-	dw.i++
-
 	if f.IsDir() {
-		if err := f.source.Pack(buf); err != nil {
+		if f.meta.Mentry, err = dw.writeEntry(f.msource); err != nil {
 			return err
 		}
-		if _, err := dw.source.Write(buf); err != nil {
-			return err
-		}
-		f.meta.Mentry = dw.i
-		dw.i++
 	}
 
 	n, _ := f.meta.PackedSize(VacDirVersion)
 	mb := dw.mb
 	if mb == nil {
-		mb = NewMetaBlock(make([]byte, dw.bsize), dw.bsize/BytesPerEntry)
+		mb = NewMetaBlock(make([]byte, dw.msize), dw.msize/BytesPerEntry)
 		dw.mb = mb
 	} else {
 		nn := (len(dw.mb.buf) * FullPercentage / 100) - dw.mb.size + dw.mb.free
@@ -330,7 +340,7 @@ func (dw *DirWriter) Add(f *File) error {
 			if _, err := dw.msource.Write(dw.mb.Pack()); err != nil {
 				return err
 			}
-			mb = NewMetaBlock(make([]byte, dw.bsize), dw.bsize/BytesPerEntry)
+			mb = NewMetaBlock(make([]byte, dw.msize), dw.msize/BytesPerEntry)
 			dw.mb = mb
 		}
 	}
@@ -356,6 +366,26 @@ func (dw *DirWriter) Add(f *File) error {
 	return nil
 }
 
+// writeEntry appends e to the directory's source and returns its
+// index. As in plan9's vac, entries do not span blocks: each block
+// holds epb entries, followed by zero padding.
+func (dw *DirWriter) writeEntry(e venti.Entry) (int, error) {
+	if dw.i > 0 && dw.i%dw.epb == 0 && dw.pad > 0 {
+		if _, err := dw.source.Write(make([]byte, dw.pad)); err != nil {
+			return 0, err
+		}
+	}
+	buf := make([]byte, venti.EntrySize)
+	if err := e.Pack(buf); err != nil {
+		return 0, err
+	}
+	if _, err := dw.source.Write(buf); err != nil {
+		return 0, err
+	}
+	dw.i++
+	return dw.i - 1, nil
+}
+
 func (dw *DirWriter) Close(meta *DirEntry) (*File, error) {
 	source, err := dw.source.Flush()
 	if err != nil {
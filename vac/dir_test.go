@@ -3,11 +3,14 @@ package vac
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 
 	venti "sigint.ca/venti2"
+	"sigint.ca/venti2/internal/leaktest"
 )
 
 func TestDirIO(t *testing.T) {
@@ -21,7 +24,7 @@ func TestDirIO(t *testing.T) {
 
 	var score venti.Score
 	if t.Run("write", func(t *testing.T) {
-		score = testWriteDir(t, ctx, client)
+		score = testWriteDir(t, ctx, client, 5)
 	}) {
 		t.Run("scan", func(t *testing.T) {
 			testScanDir(t, ctx, client, score)
@@ -29,11 +32,185 @@ func TestDirIO(t *testing.T) {
 	}
 }
 
-func testWriteDir(t *testing.T, ctx context.Context, bw venti.BlockWriter) venti.Score {
+func TestDirWriterSubdir(t *testing.T) {
+	ctx := context.Background()
+
+	client, err := venti.Dial(ctx, ":17034")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// a directory holding a file, within another directory
+	bsize := 1024
+	w := NewDirWriter(ctx, client, bsize)
+	f, err := NewFile(ctx, client, strings.NewReader("foo"), &DirEntry{Elem: "f"}, bsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(f); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := w.Close(&DirEntry{Elem: "sub", Mode: 0755 | ModeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewDirWriter(ctx, client, bsize)
+	if err := w.Add(sub); err != nil {
+		t.Fatal(err)
+	}
+	parent, err := w.Close(&DirEntry{Elem: "parent", Mode: 0755 | ModeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parent holds the subdirectory's source and meta source
+	ff, err := parent.Walk(ctx, client, sub.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff.source.Score != sub.source.Score {
+		t.Errorf("bad source:\n\twant=%v,\n\t got=%v", sub.source.Score, ff.source.Score)
+	}
+	if ff.msource.Score != sub.msource.Score {
+		t.Errorf("bad meta source:\n\twant=%v,\n\t got=%v", sub.msource.Score, ff.msource.Score)
+	}
+}
+
+func TestDirIOMem(t *testing.T) {
+	ctx := context.Background()
+	m := venti.NewMemStore()
+
+	// 100 files need several blocks of directory entries
+	for _, n := range []int{5, 100} {
+		score := testWriteDir(t, ctx, m, n)
+		if got := testScanDir(t, ctx, m, score); got != n {
+			t.Errorf("scanned %d files, want %d", got, n)
+		}
+	}
+
+	// a missing block is reported as such through vac
+	root := &venti.Root{Score: venti.Fingerprint([]byte("missing"))}
+	if _, err := ReadRoot(ctx, m, root); !errors.Is(err, venti.ErrNotFound) {
+		t.Errorf("read missing root: got %v, want %v", err, venti.ErrNotFound)
+	}
+}
+
+func TestWalkRoot(t *testing.T) {
+	ctx := context.Background()
+
+	// 100 files need several blocks of directory entries
+	for _, nfile := range []int{5, 100} {
+		m := venti.NewMemStore()
+		score := testWriteDir(t, ctx, m, nfile)
+
+		for _, n := range []int{1, 4} {
+			var mu sync.Mutex
+			visited := make(map[venti.Score]bool)
+			err := WalkRoot(ctx, m, score, func(s venti.Score, bt venti.BlockType, depth int) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if visited[s] {
+					return venti.SkipTree
+				}
+				visited[s] = true
+				return nil
+			}, venti.WithWalkConcurrency(n))
+			if err != nil {
+				t.Fatalf("%d files: %v", nfile, err)
+			}
+			// every block of the archive is reachable from its root
+			if len(visited) != m.Len() {
+				t.Errorf("%d files, concurrency %d: visited %d blocks, store has %d", nfile, n, len(visited), m.Len())
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	m := venti.NewMemStore()
+
+	data := strings.Repeat("abcdefgh", 1000)
+	a, err := NewFile(ctx, m, strings.NewReader(data), &DirEntry{Elem: "a"}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := data[:5000] + "X" + data[5001:] + "tail"
+	b, err := NewFile(ctx, m, strings.NewReader(edited), &DirEntry{Elem: "a"}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges, err := Diff(ctx, m, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last block of a differs from the same block of b,
+	// and merges with the tail of b
+	want := []venti.Range{{Off: 4096, Len: 1024}, {Off: 7168, Len: 836}}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", ranges, want)
+	}
+}
+
+func TestDirLookup(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx := context.Background()
+	m := venti.NewMemStore()
+
+	// enough entries for several meta blocks
+	bsize := 512
+	w := NewDirWriter(ctx, m, bsize)
+	for i := 0; i < 50; i++ {
+		de := DirEntry{Elem: fmt.Sprintf("file%02d", i)}
+		f, err := NewFile(ctx, m, strings.NewReader(de.Elem), &de, bsize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Add(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := w.Close(&DirEntry{Elem: "dir", Mode: 0755 | ModeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, elem := range []string{"file00", "file49"} {
+		de, err := dir.DirLookup(ctx, m, elem)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", elem, err)
+		}
+		if de.Elem != elem {
+			t.Errorf("lookup %s: got %s", elem, de.Elem)
+		}
+	}
+
+	if _, err := dir.DirLookup(ctx, m, "missing"); err != EntryNotFound {
+		t.Errorf("lookup missing: got %v, want %v", err, EntryNotFound)
+	}
+
+	// stop scanning early
+	scanner := NewDirScanner(ctx, m, dir)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	if err := scanner.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if scanner.Scan() {
+		t.Error("scan after close")
+	}
+}
+
+// testWriteDir writes an archive of a directory holding n files.
+func testWriteDir(t *testing.T, ctx context.Context, bw venti.BlockWriter, n int) venti.Score {
 	bsize := 1024
 	w := NewDirWriter(ctx, bw, bsize)
 
-	for i := 0; i < 5; i++ {
+	for i := 0; i < n; i++ {
 		r := strings.NewReader(fmt.Sprintf("foo %d", i))
 		de := DirEntry{Elem: fmt.Sprintf("f%d", i)}
 		f, err := NewFile(ctx, bw, r, &de, bsize)
@@ -57,7 +234,9 @@ func testWriteDir(t *testing.T, ctx context.Context, bw venti.BlockWriter) venti
 	return score
 }
 
-func testScanDir(t *testing.T, ctx context.Context, br venti.BlockReader, score venti.Score) {
+// testScanDir reads back an archive written by testWriteDir,
+// and returns the number of files in it.
+func testScanDir(t *testing.T, ctx context.Context, br venti.BlockReader, score venti.Score) int {
 	buf := make([]byte, venti.RootSize)
 	if _, err := br.ReadBlock(ctx, score, venti.RootType, buf); err != nil {
 		t.Fatalf("read root: %v", err)
@@ -73,20 +252,26 @@ func testScanDir(t *testing.T, ctx context.Context, br venti.BlockReader, score
 		t.Fatal(err)
 	}
 
+	var n int
 	scanner := NewDirScanner(ctx, br, f)
-	for scanner.Scan() {
+	for ; scanner.Scan(); n++ {
 		de := scanner.DirEntry()
 		f, err := f.Walk(ctx, br, de)
 		if err != nil {
 			t.Fatal(err)
 		}
 		var buf bytes.Buffer
-		if _, err := f.Reader(ctx, br).WriteTo(&buf); err != nil {
+		r := f.Reader(ctx, br)
+		if _, err := r.WriteTo(&buf); err != nil {
 			t.Fatal(err)
 		}
-		t.Logf("%s: %q", de.Elem, buf.String())
+		r.Close()
+		if want := "foo " + de.Elem[1:]; buf.String() != want {
+			t.Errorf("%s: got %q, want %q", de.Elem, buf.String(), want)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		t.Error(err)
 	}
+	return n
 }
@@ -7,7 +7,6 @@ package vac
 // limited to actual network requests.
 
 import (
-	"bytes"
 	"context"
 	"io"
 
@@ -22,9 +21,10 @@ type File struct {
 	msource venti.Entry // metadata for children in a directory
 }
 
-func NewFile(ctx context.Context, bw venti.BlockWriter, r io.Reader, meta *DirEntry, bsize int) (*File, error) {
-	psize := (bsize / venti.ScoreSize) * venti.ScoreSize
-	sw := venti.NewWriter(ctx, bw, venti.DataType, psize, bsize)
+// NewFile writes the data read from r to bw, and returns a File
+// describing it. If r is a venti.HoleReader, its holes are not read.
+func NewFile(ctx context.Context, bw venti.BlockWriter, r io.Reader, meta *DirEntry, bsize int, opts ...venti.WriterOption) (*File, error) {
+	sw := venti.NewWriter(ctx, bw, venti.DataType, venti.PointerSize(bsize), bsize, opts...)
 	if _, err := sw.ReadFrom(r); err != nil {
 		return nil, err
 	}
@@ -43,22 +43,16 @@ func (f *File) Name() string {
 	return f.meta.Elem
 }
 
-// TODO: document f.source offset after the operation
+// Walk returns the child of directory f described by de,
+// reading only the blocks of f's source which hold its entries.
 func (f *File) Walk(ctx context.Context, br venti.BlockReader, de *DirEntry) (*File, error) {
 	if !f.IsDir() {
 		return nil, errNotDir
 	}
 
-	// TODO: seek without reading the whole source into memory
-	var buf bytes.Buffer
-	_, err := venti.NewReader(ctx, br, f.source).WriteTo(&buf)
-	r := bytes.NewReader(buf.Bytes())
-
-	off := int64(de.Entry) * venti.EntrySize
-	if _, err := r.Seek(off, io.SeekStart); err != nil {
-		return nil, err
-	}
-	e, err := venti.ReadEntry(r)
+	r := venti.NewReader(ctx, br, f.source)
+	defer r.Close()
+	e, err := readEntryAt(r, f.source.Dsize, de.Entry)
 	if err != nil {
 		return nil, err
 	}
@@ -69,11 +63,7 @@ func (f *File) Walk(ctx context.Context, br venti.BlockReader, de *DirEntry) (*F
 	}
 
 	if e.IsDir() {
-		off := int64(de.Mentry) * venti.EntrySize
-		if _, err := r.Seek(off, io.SeekStart); err != nil {
-			return nil, err
-		}
-		ee, err := venti.ReadEntry(r)
+		ee, err := readEntryAt(r, f.source.Dsize, de.Mentry)
 		if err != nil {
 			return nil, err
 		}
@@ -83,15 +73,35 @@ func (f *File) Walk(ctx context.Context, br venti.BlockReader, de *DirEntry) (*F
 	return &ff, nil
 }
 
+// readEntryAt reads the i'th entry of the directory source read by r,
+// whose blocks of size dsize each hold dsize/EntrySize entries.
+func readEntryAt(r io.ReadSeeker, dsize, i int) (venti.Entry, error) {
+	epb := dsize / venti.EntrySize
+	off := int64(i/epb)*int64(dsize) + int64(i%epb)*venti.EntrySize
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return venti.Entry{}, err
+	}
+	return venti.ReadEntry(r)
+}
+
 // TODO: shouldn't need to pass in br
 func (f *File) DirLookup(ctx context.Context, br venti.BlockReader, elem string) (*DirEntry, error) {
 	r := venti.NewReader(ctx, br, f.msource)
+	defer r.Close()
 	buf := make([]byte, f.msource.Dsize)
 	for {
-		_, err := io.ReadFull(r, buf)
-		if err != nil {
+		// each read returns at most one meta block, which
+		// may have been truncated, as in DirScanner.next
+		n, err := r.Read(buf)
+		if err == io.EOF {
+			return nil, EntryNotFound
+		} else if err != nil {
 			return nil, err
 		}
+		if n == 0 {
+			continue
+		}
+		memset(buf[n:], 0)
 		mb, err := UnpackMetaBlock(buf)
 		if err == io.EOF {
 			return nil, EntryNotFound
@@ -114,6 +124,15 @@ func (f *File) IsDir() bool {
 	return f.meta.Mode&ModeDir != 0
 }
 
-func (f *File) Reader(ctx context.Context, br venti.BlockReader) *venti.SourceReader {
-	return venti.NewReader(ctx, br, f.source)
+// Reader returns a reader for the contents of f,
+// which the caller must close.
+func (f *File) Reader(ctx context.Context, br venti.BlockReader, opts ...venti.ReaderOption) *venti.SourceReader {
+	return venti.NewReader(ctx, br, f.source, opts...)
+}
+
+// Diff returns the ranges of bytes which differ between the
+// contents of a and b, such as two versions of a file in
+// successive snapshots, as described by venti.Diff.
+func Diff(ctx context.Context, br venti.BlockReader, a, b *File) ([]venti.Range, error) {
+	return venti.Diff(ctx, br, a.source, b.source)
 }
@@ -13,7 +13,7 @@ func ReadRoot(ctx context.Context, br venti.BlockReader, root *venti.Root) (*Fil
 	entryBuf := make([]byte, 3*venti.EntrySize)
 	n, err := br.ReadBlock(ctx, root.Score, venti.DirType, entryBuf)
 	if err != nil {
-		return nil, fmt.Errorf("read root venti directory: %v", err)
+		return nil, fmt.Errorf("read root venti directory: %w", err)
 	}
 	if n != 3*venti.EntrySize {
 		return nil, errors.New("bad root venti directory size")
@@ -34,16 +34,18 @@ func ReadRoot(ctx context.Context, br venti.BlockReader, root *venti.Root) (*Fil
 	}
 
 	var metaBuf bytes.Buffer
-	if n, err := venti.NewReader(ctx, br, rmeta).WriteTo(&metaBuf); err != nil {
-		return nil, fmt.Errorf("read root meta block: %v (read %d)", err, n)
+	mr := venti.NewReader(ctx, br, rmeta)
+	defer mr.Close()
+	if n, err := mr.WriteTo(&metaBuf); err != nil {
+		return nil, fmt.Errorf("read root meta block: %w (read %d)", err, n)
 	}
 	mb, err := UnpackMetaBlock(metaBuf.Bytes())
 	if err != nil {
-		return nil, fmt.Errorf("unpack root meta block: %v", err)
+		return nil, fmt.Errorf("unpack root meta block: %w", err)
 	}
 	me, err := mb.unpackMetaEntry(0)
 	if err != nil {
-		return nil, fmt.Errorf("unpack root meta entry: %v", err)
+		return nil, fmt.Errorf("unpack root meta entry: %w", err)
 	}
 
 	meta, err := mb.unpackDirEntry(me)
@@ -61,7 +63,8 @@ func ReadRoot(ctx context.Context, br venti.BlockReader, root *venti.Root) (*Fil
 }
 
 func WriteRoot(ctx context.Context, bw venti.BlockWriter, dir *File) (venti.Score, error) {
-	dsize, psize := dir.source.Dsize, dir.source.Psize
+	dsize := dir.source.Dsize
+	msize := metaBlockSize(dsize)
 
 	// root dir block
 	buf := make([]byte, 3*venti.EntrySize)
@@ -77,7 +80,7 @@ func WriteRoot(ctx context.Context, bw venti.BlockWriter, dir *File) (venti.Scor
 	}
 
 	// meta block
-	mb := NewMetaBlock(make([]byte, dsize), dsize/BytesPerEntry)
+	mb := NewMetaBlock(make([]byte, msize), msize/BytesPerEntry)
 	n, _ := dir.meta.PackedSize(VacDirVersion)
 	off, err := mb.Alloc(n)
 	if err != nil {
@@ -97,11 +100,11 @@ func WriteRoot(ctx context.Context, bw venti.BlockWriter, dir *File) (venti.Scor
 	}
 	// meta block entry
 	mentry := venti.Entry{
-		Psize: psize,
-		Dsize: dsize,
+		Psize: venti.PointerSize(msize),
+		Dsize: msize,
 		Type:  venti.DataType,
 		Flags: venti.EntryActive,
-		Size:  int64(dsize),
+		Size:  int64(msize),
 		Score: mscore,
 	}
 	if err := mentry.Pack(buf[2*venti.EntrySize:]); err != nil {
@@ -27,6 +27,16 @@ const (
 	DirtyPercentage = 50  // maximum percentage of dirty blocks
 )
 
+// metaBlockSize returns the size of meta blocks in a directory
+// with the given block size. The offsets in a meta block are 16 bits,
+// so meta blocks are never larger than venti.MaxBlockSize.
+func metaBlockSize(bsize int) int {
+	if bsize > venti.MaxBlockSize {
+		return venti.MaxBlockSize
+	}
+	return bsize
+}
+
 type MetaBlock struct {
 	size int // size used
 	free int // free space within used size
@@ -279,6 +289,8 @@ func (mb *MetaBlock) Search(elem string) (found bool, i int, me MetaEntry, err e
 		panic("invariant failed")
 	}
 
+	// the index at which elem would be inserted
+	i = b
 	return
 }
 
@@ -0,0 +1,44 @@
+package vac
+
+import (
+	"context"
+	"fmt"
+
+	venti "sigint.ca/venti2"
+)
+
+// WalkRoot calls fn for every block of the vac archive with the
+// given root score: the root block, the root venti directory, and
+// the trees of the entries it holds, descending into the sources of
+// every file and directory. The archive's previous root, if any, is
+// not visited. The root block is at depth 0; otherwise fn and opts
+// are as for venti.Walk.
+func WalkRoot(ctx context.Context, br venti.BlockReader, score venti.Score, fn venti.WalkFunc, opts ...venti.WalkOption) error {
+	if err := fn(score, venti.RootType, 0); err == venti.SkipTree {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	buf := make([]byte, venti.RootSize)
+	if _, err := br.ReadBlock(ctx, score, venti.RootType, buf); err != nil {
+		return fmt.Errorf("read root: %w", err)
+	}
+	root, err := venti.UnpackRoot(buf)
+	if err != nil {
+		return err
+	}
+
+	// the root venti directory, as read by ReadRoot
+	e := venti.Entry{
+		Psize: venti.PointerSize(root.BlockSize),
+		Dsize: root.BlockSize,
+		Type:  venti.DirType,
+		Flags: venti.EntryActive,
+		Size:  3 * venti.EntrySize,
+		Score: root.Score,
+	}
+	return venti.Walk(ctx, br, e, func(s venti.Score, t venti.BlockType, depth int) error {
+		return fn(s, t, depth+1)
+	}, opts...)
+}
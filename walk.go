@@ -0,0 +1,157 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A WalkFunc is called by Walk for each block of a tree. The depth
+// is the number of blocks above it on the path from the root of
+// the walk, counting the blocks of enclosing directory sources.
+//
+// If it returns SkipTree, the blocks beneath the block are not
+// visited; any other error stops the walk, and is returned by Walk.
+type WalkFunc func(score Score, t BlockType, depth int) error
+
+// SkipTree is returned by a WalkFunc to skip the blocks beneath a
+// block, such as one which has already been visited. It is not
+// returned as an error by Walk.
+var SkipTree = errors.New("skip this tree")
+
+// DefaultWalkConcurrency is the default number of goroutines
+// used by Walk. With one, blocks are visited depth first, in order.
+const DefaultWalkConcurrency = 1
+
+// A WalkOption configures Walk.
+type WalkOption func(*walkConfig)
+
+type walkConfig struct {
+	concurrency int
+}
+
+// WithWalkConcurrency sets the number of goroutines visiting
+// subtrees, and so the number of blocks read in parallel.
+func WithWalkConcurrency(n int) WalkOption {
+	return func(c *walkConfig) {
+		c.concurrency = n
+	}
+}
+
+// Walk calls fn for every block of the tree described by e: the
+// pointer blocks at each depth and the data blocks. The data blocks
+// of a directory source are read, and the tree of each active entry
+// they hold is walked in turn. Zero scores are not visited, as they
+// are never stored.
+//
+// fn is called for a block before the blocks beneath it. The calls
+// are serialized, but with a concurrency above one, subtrees are
+// visited in no particular order.
+func Walk(ctx context.Context, br BlockReader, e Entry, fn WalkFunc, opts ...WalkOption) error {
+	cfg := walkConfig{concurrency: DefaultWalkConcurrency}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := walker{
+		ctx:     ctx,
+		br:      br,
+		fn:      fn,
+		workers: make(chan struct{}, cfg.concurrency-1),
+		err:     &firstError{cancel: cancel},
+	}
+	w.visit(&e, e.Score, e.Type, 0)
+	w.wg.Wait()
+	if err := w.err.get(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+type walker struct {
+	ctx context.Context
+	br  BlockReader
+
+	mu sync.Mutex // serializes calls to fn
+	fn WalkFunc
+
+	workers chan struct{} // a token for each extra goroutine
+	wg      sync.WaitGroup
+	err     *firstError
+}
+
+// visit visits the block with score s and type t, in the source
+// described by e, and the blocks beneath it.
+func (w *walker) visit(e *Entry, s Score, t BlockType, depth int) {
+	if s == ZeroScore() || w.ctx.Err() != nil {
+		return
+	}
+
+	w.mu.Lock()
+	err := w.fn(s, t, depth)
+	w.mu.Unlock()
+	if err == SkipTree {
+		return
+	} else if err != nil {
+		w.err.set(err)
+		return
+	}
+
+	if t.depth() == 0 && t != DirType {
+		// a data block: nothing beneath
+		return
+	}
+
+	size := e.Psize
+	if t == DirType {
+		size = e.Dsize
+	}
+	buf := make([]byte, size)
+	n, err := w.br.ReadBlock(w.ctx, s, t, buf)
+	if err != nil {
+		if w.ctx.Err() == nil {
+			w.err.set(fmt.Errorf("walk %v block %v: %w", t, s, err))
+		}
+		return
+	}
+
+	if t == DirType {
+		for i := 0; i+EntrySize <= n; i += EntrySize {
+			ee, err := UnpackEntry(buf[i : i+EntrySize])
+			if err != nil {
+				w.err.set(fmt.Errorf("walk %v block %v: entry %d: %w", t, s, i/EntrySize, err))
+				return
+			}
+			if ee.Flags&EntryActive == 0 {
+				continue
+			}
+			w.spawn(&ee, ee.Score, ee.Type, depth+1)
+		}
+		return
+	}
+	for i := 0; i+ScoreSize <= n; i += ScoreSize {
+		w.spawn(e, unpackScore(buf, i/ScoreSize), t-1, depth+1)
+	}
+}
+
+// spawn visits a subtree in a new goroutine if there is a
+// worker available, and otherwise in the current one.
+func (w *walker) spawn(e *Entry, s Score, t BlockType, depth int) {
+	select {
+	case w.workers <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.visit(e, s, t, depth)
+			<-w.workers
+		}()
+	default:
+		w.visit(e, s, t, depth)
+	}
+}
@@ -0,0 +1,97 @@
+package venti
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// writeDirSource writes a directory source holding the given entries.
+func writeDirSource(t *testing.T, m *MemStore, entries ...Entry) Entry {
+	t.Helper()
+	w := NewWriter(context.Background(), m, DirType, 13*ScoreSize, 7*EntrySize)
+	buf := make([]byte, EntrySize)
+	for _, e := range entries {
+		if err := e.Pack(buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+
+	data := testData(5000)
+	e1 := writeSource(t, m, data, 13*ScoreSize, 256)
+	e2 := writeSource(t, m, data[:2000], 13*ScoreSize, 256)
+	e3 := writeSource(t, m, nil, 13*ScoreSize, 256)
+	var entries []Entry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, e1, e2, Entry{}, e3)
+	}
+	dir := writeDirSource(t, m, entries...)
+	root := writeDirSource(t, m, dir, e1)
+	if dir.Depth() == 0 || e1.Depth() < 2 {
+		t.Fatalf("trees are too shallow: %d, %d", dir.Depth(), e1.Depth())
+	}
+
+	for _, n := range []int{1, 8} {
+		// visit each block once, skipping the
+		// subtrees which are shared
+		var mu sync.Mutex
+		visited := make(map[memKey]int)
+		err := Walk(ctx, m, root, func(s Score, bt BlockType, depth int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			k := memKey{s, bt.onDiskType()}
+			visited[k]++
+			if visited[k] > 1 {
+				return SkipTree
+			}
+			if depth == 0 && s != root.Score {
+				t.Errorf("depth 0 block %v is not the root", s)
+			}
+			return nil
+		}, WithWalkConcurrency(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(visited) != m.Len() {
+			t.Errorf("concurrency %d: visited %d blocks, store has %d", n, len(visited), m.Len())
+		}
+		for k := range visited {
+			if _, ok := m.blocks[k]; !ok {
+				t.Errorf("visited %v, which is not stored", k.score)
+			}
+		}
+	}
+
+	// errors from fn stop the walk
+	errStop := errors.New("stop")
+	err := Walk(ctx, m, root, func(s Score, bt BlockType, depth int) error {
+		if bt == DataType {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("got %v, want %v", err, errStop)
+	}
+
+	// as do read errors
+	fs := &faultyStore{MemStore: m, fail: DataType + 1, after: 2}
+	err = Walk(ctx, fs, root, func(Score, BlockType, int) error { return nil }, WithWalkConcurrency(4))
+	if !errors.Is(err, errInjected) {
+		t.Errorf("got %v, want %v", err, errInjected)
+	}
+}
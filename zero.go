@@ -38,7 +38,7 @@ func ZeroTruncate(t BlockType, buf []byte) []byte {
 		zero := ZeroScore()
 		zeroBytes := zero.Bytes()
 		for i >= ScoreSize {
-			if bytes.Equal(buf[i-ScoreSize:i], zeroBytes) {
+			if !bytes.Equal(buf[i-ScoreSize:i], zeroBytes) {
 				break
 			}
 			i -= ScoreSize
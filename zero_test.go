@@ -0,0 +1,16 @@
+package venti
+
+import "testing"
+
+func TestZeroTruncatePointers(t *testing.T) {
+	zero := ZeroScore()
+	s := Fingerprint([]byte("x"))
+	buf := append(append(s.Bytes(), zero.Bytes()...), zero.Bytes()...)
+	if got := ZeroTruncate(DataType+1, buf); len(got) != ScoreSize {
+		t.Errorf("got %d bytes, want %d", len(got), ScoreSize)
+	}
+	buf = append(zero.Bytes(), zero.Bytes()...)
+	if got := ZeroTruncate(DataType+1, buf); len(got) != 0 {
+		t.Errorf("got %d bytes, want 0", len(got))
+	}
+}